@@ -0,0 +1,106 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import "fmt"
+
+// A SyntaxError describes a malformed part of a URI template.
+type SyntaxError struct {
+	// Template is the template's source text.
+	Template string
+	// Offset is the byte offset of the malformed text in the template.
+	Offset int
+	// Len is the length in bytes of the malformed text.
+	Len int
+	// Code describes the kind of error.
+	Code ErrorCode
+}
+
+// Error returns a description of the error
+// that includes the template and the malformed text.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("uri template %q: offset %d: %v %q",
+		e.Template, e.Offset, e.Code, e.Template[e.Offset:e.Offset+e.Len])
+}
+
+// An ErrorList is a list of syntax errors in a template,
+// in the order they appear.
+type ErrorList []*SyntaxError
+
+// Error returns a description of the first error in the list
+// and the number of other errors.
+func (list ErrorList) Error() string {
+	switch len(list) {
+	case 0:
+		return "no errors"
+	case 1:
+		return list[0].Error()
+	case 2:
+		return list[0].Error() + " (and 1 more error)"
+	default:
+		return fmt.Sprintf("%v (and %d more errors)", list[0], len(list)-1)
+	}
+}
+
+// Unwrap returns the errors in the list.
+func (list ErrorList) Unwrap() []error {
+	errs := make([]error, len(list))
+	for i, e := range list {
+		errs[i] = e
+	}
+	return errs
+}
+
+// An ErrorCode describes the kind of a [SyntaxError].
+type ErrorCode string
+
+// Syntax error codes.
+const (
+	ErrIllegalCharacter       ErrorCode = "illegal character"
+	ErrInvalidPercentEscape   ErrorCode = "invalid percent escape"
+	ErrUnterminatedExpression ErrorCode = "unterminated expression"
+	ErrEmptyExpression        ErrorCode = "empty expression"
+	ErrUnknownOperator        ErrorCode = "unknown operator"
+	ErrMissingVariableName    ErrorCode = "missing variable name"
+	ErrUnexpectedCharacter    ErrorCode = "unexpected character"
+	ErrLevelExceeded          ErrorCode = "expression above maximum level"
+)
+
+// String returns the error code's description.
+func (code ErrorCode) String() string {
+	return string(code)
+}
+
+// A ValueError is returned by expansion
+// when a variable's value could not be converted to a string,
+// such as when a MarshalText method returns an error.
+type ValueError struct {
+	// Name is the name of the variable.
+	Name string
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns a description of the error that includes the variable name.
+func (e *ValueError) Error() string {
+	return fmt.Sprintf("variable %s: %v", e.Name, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *ValueError) Unwrap() error {
+	return e.Err
+}
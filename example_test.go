@@ -48,3 +48,85 @@ func ExampleExpand_struct() {
 	// Output:
 	// /foo?color=r&color=g&color=b
 }
+
+func ExamplePairs() {
+	expanded, err := uritemplate.Expand("/download{?params*}", map[string]any{
+		"params": uritemplate.Pairs{
+			{Key: "expires", Value: 1700000000},
+			{Key: "key", Value: "abc"},
+			{Key: "signature", Value: "x+y="},
+		},
+	})
+	if err != nil {
+		// handle error
+	}
+	fmt.Println(expanded)
+	// Output:
+	// /download?expires=1700000000&key=abc&signature=x%2By%3D
+}
+
+func ExampleParse() {
+	tmpl, err := uritemplate.Parse("/users/{id}/posts{?page,limit}")
+	if err != nil {
+		// handle error
+	}
+	expanded, err := tmpl.Expand(map[string]any{
+		"id":   42,
+		"page": 2,
+	})
+	if err != nil {
+		// handle error
+	}
+	fmt.Println(expanded)
+	// Output:
+	// /users/42/posts?page=2
+}
+
+func ExampleTemplate_With() {
+	base := uritemplate.MustParse("https://{host}/{version}/users/{id}")
+	v2 := base.With(map[string]any{
+		"host":    "api.example.com",
+		"version": "v2",
+	})
+	expanded, err := v2.Expand(map[string]any{"id": 42})
+	if err != nil {
+		// handle error
+	}
+	fmt.Println(expanded)
+	// Output:
+	// https://api.example.com/v2/users/42
+}
+
+func ExampleTemplate_Level() {
+	for _, s := range []string{"/users/{id}", "{+base}/users", "/users{?page,limit}", "/files{/path*}"} {
+		fmt.Println(uritemplate.MustParse(s).Level(), s)
+	}
+	// Output:
+	// 1 /users/{id}
+	// 2 {+base}/users
+	// 3 /users{?page,limit}
+	// 4 /files{/path*}
+}
+
+func ExampleTemplate_Match() {
+	tmpl := uritemplate.MustParse("/users/{id}/posts{?page,limit}")
+	values, err := tmpl.Match("/users/42/posts?page=2")
+	if err != nil {
+		// handle error
+	}
+	fmt.Println(values["id"], values["page"])
+	// Output:
+	// 42 2
+}
+
+func ExampleTemplate_Variables() {
+	tmpl := uritemplate.MustParse("/repos/{owner}/{repo}/issues{?state,labels*}")
+	for _, v := range tmpl.Variables() {
+		fmt.Println(v.Name)
+	}
+	// Output:
+	// owner
+	// repo
+	// state
+	// labels
+}
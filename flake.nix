@@ -15,7 +15,7 @@
       let
         pkgs = import nixpkgs { inherit system; };
       in {
-        packages.go = pkgs.go_1_19;
+        packages.go = pkgs.go_1_20;
 
         devShells.default = pkgs.mkShell {
           packages = [
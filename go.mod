@@ -1,3 +1,3 @@
 module zombiezen.com/go/uritemplate
 
-go 1.19
+go 1.20
@@ -0,0 +1,413 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrNoMatch is returned by [Template.Match]
+// when a URI could not have been produced by the template.
+var ErrNoMatch = errors.New("uri does not match template")
+
+// A Value is a variable value extracted from a URI by [Template.Match].
+// An expanded URI does not record whether a variable was a string,
+// a value list, or an associative array,
+// so a Value keeps the individual components that were matched
+// and lets the caller choose how to interpret them.
+type Value struct {
+	// items is the list of percent-decoded components.
+	items []string
+	// keys is non-nil if the value was matched as an exploded associative array,
+	// in which case keys[i] is the name of items[i].
+	keys []string
+}
+
+// String returns the value interpreted as a string.
+// Components are joined by commas,
+// which matches how a list would be expanded
+// by a simple string expansion.
+func (v Value) String() string {
+	if v.keys == nil {
+		return strings.Join(v.items, ",")
+	}
+	return strings.Join(v.List(), ",")
+}
+
+// List returns the value interpreted as a value list.
+// An exploded associative array is returned as alternating keys and values.
+func (v Value) List() []string {
+	if v.keys == nil {
+		return append([]string(nil), v.items...)
+	}
+	list := make([]string, 0, len(v.items)*2)
+	for i, k := range v.keys {
+		list = append(list, k, v.items[i])
+	}
+	return list
+}
+
+// Map returns the value interpreted as an associative array.
+// Values that were not matched as exploded associative arrays
+// are interpreted as alternating keys and values,
+// with an empty value for a trailing key.
+func (v Value) Map() map[string]string {
+	m := make(map[string]string)
+	if v.keys != nil {
+		for i, k := range v.keys {
+			m[k] = v.items[i]
+		}
+		return m
+	}
+	for i := 0; i < len(v.items); i += 2 {
+		if i+1 < len(v.items) {
+			m[v.items[i]] = v.items[i+1]
+		} else {
+			m[v.items[i]] = ""
+		}
+	}
+	return m
+}
+
+// Match extracts variable values from a URI that was produced by expanding t.
+// Values are percent-decoded.
+// A "+" is not decoded to a space,
+// so query parameters from HTML forms keep their "+" characters.
+// Variables that were not present in the expansion
+// are not present in the returned map.
+// If the URI could not have been produced by the template,
+// then Match returns an error that wraps [ErrNoMatch].
+//
+// Matching is the inverse of expansion, but the inverse is not always unique.
+// Match prefers the following interpretations:
+//
+//   - A variable in a simple string, reserved, or fragment expansion
+//     that shares the expression with other variables matches one component,
+//     since the list separator is the same as the variable separator.
+//   - An exploded variable is an associative array
+//     if every one of its components contains "=".
+//     Otherwise, it is a value list.
+//   - Parameters in form-style query expressions
+//     that do not correspond to a variable are ignored
+//     unless the expression has an exploded variable to collect them.
+//
+// A form-style query continuation that immediately follows
+// another form-style query expression, like "{?q}{&page}",
+// is matched together with it as one query string,
+// so their parameters are matched by name in any order.
+//
+// Some templates cannot be matched reliably,
+// such as templates with adjacent expressions
+// or with an exploded variable that is not last in an expression.
+// Match returns an error for such templates.
+func (t *Template) Match(uri string) (map[string]Value, error) {
+	t.matchOnce.Do(t.compileMatcher)
+	if t.matchErr != nil {
+		return nil, t.matchErr
+	}
+	submatches := t.matchRegexp.FindStringSubmatch(uri)
+	if submatches == nil {
+		return nil, fmt.Errorf("match %q against %q: %w", uri, t.s, ErrNoMatch)
+	}
+	values := make(map[string]Value)
+	for i, expr := range t.matchExprs {
+		if !matchExpression(values, expr, submatches[i+1]) {
+			return nil, fmt.Errorf("match %q against %q: %w", uri, t.s, ErrNoMatch)
+		}
+	}
+	return values, nil
+}
+
+func (t *Template) compileMatcher() {
+	sb := new(strings.Builder)
+	sb.WriteString("^")
+	var prev *Expression
+	for _, p := range t.parts {
+		if prev != nil && p.expr != nil && continuesQuery(prev.Operator, p.expr.Operator) {
+			// Match the query parameters of both expressions in one group.
+			last := t.matchExprs[len(t.matchExprs)-1]
+			t.matchExprs[len(t.matchExprs)-1] = &Expression{
+				Operator: last.Operator,
+				Vars:     append(append([]VarSpec(nil), last.Vars...), p.expr.Vars...),
+			}
+			sb.WriteString(expressionPattern(p.expr.Operator))
+			prev = p.expr
+			continue
+		}
+		if prev != nil {
+			sb.WriteString(")")
+		}
+		if p.expr == nil {
+			sb.WriteString(regexp.QuoteMeta(p.literal))
+			prev = nil
+			continue
+		}
+		if err := checkMatchable(prev, p.expr); err != nil {
+			t.matchErr = fmt.Errorf("match against uri template %q: %v", t.s, err)
+			return
+		}
+		sb.WriteString("(")
+		sb.WriteString(expressionPattern(p.expr.Operator))
+		t.matchExprs = append(t.matchExprs, p.expr)
+		prev = p.expr
+	}
+	if prev != nil {
+		sb.WriteString(")")
+	}
+	sb.WriteString("$")
+	t.matchRegexp = regexp.MustCompile(sb.String())
+}
+
+// continuesQuery reports whether an expression with the operator next
+// continues the form-style query of an immediately preceding expression
+// with the operator prev.
+func continuesQuery(prev, next Operator) bool {
+	return (prev == OpQuery || prev == OpQueryContinuation) && next == OpQueryContinuation
+}
+
+// checkMatchable returns an error if expr cannot be reliably matched.
+// prev is the expression immediately preceding expr
+// or nil if expr is preceded by a literal or the beginning of the template.
+func checkMatchable(prev, expr *Expression) error {
+	if prev != nil && !opHasDistinctPrefix(prev.Operator, expr.Operator) {
+		return fmt.Errorf("expression %s is ambiguous for matching: adjacent to previous expression", expr)
+	}
+	if opUsesNames(expr.Operator) || len(expr.Vars) < 2 {
+		return nil
+	}
+	for _, spec := range expr.Vars[:len(expr.Vars)-1] {
+		if spec.Explode {
+			return fmt.Errorf("expression %s is ambiguous for matching: exploded variable %s is not last", expr, spec.Name)
+		}
+	}
+	return nil
+}
+
+// opHasDistinctPrefix reports whether an expansion with the operator next
+// always starts with a character that cannot appear
+// in an expansion with the operator prev.
+func opHasDistinctPrefix(prev, next Operator) bool {
+	if next == 0 || next == '+' {
+		return false
+	}
+	switch prev {
+	case 0:
+		return strings.IndexByte(",=", byte(next)) == -1 && !isUnreserved(rune(next))
+	case '+', '#':
+		return false
+	case '.', '/', ';':
+		return strings.IndexByte(",=", byte(next)) == -1 && !isUnreserved(rune(next)) && next != prev
+	case '?', '&':
+		// A query may contain any of the other operators except "#".
+		return next == '#'
+	default:
+		panic("unreachable")
+	}
+}
+
+const (
+	unreservedClass = `A-Za-z0-9\-._~`
+	reservedClass   = `:/?#\[\]@!$&'()*+,;=`
+	// queryClass is the set of characters other than "&"
+	// that RFC 3986 allows unescaped in a query.
+	queryClass = `!$'()*+,;=:@/?`
+	pctPattern = `%[0-9A-Fa-f]{2}`
+)
+
+// expressionPattern returns a regular expression without capturing groups
+// that matches any expansion of an expression with the given operator.
+func expressionPattern(op Operator) string {
+	switch op {
+	case 0:
+		return `(?:[` + unreservedClass + `,=]|` + pctPattern + `)*`
+	case '+':
+		return `(?:[` + unreservedClass + reservedClass + `]|` + pctPattern + `)*`
+	case '#':
+		return `(?:#(?:[` + unreservedClass + reservedClass + `]|` + pctPattern + `)*)?`
+	case '.', '/', ';':
+		return `(?:` + regexp.QuoteMeta(op.String()) + `(?:[` + unreservedClass + `,=]|` + pctPattern + `)*)*`
+	case '&':
+		return `(?:&(?:[` + unreservedClass + queryClass + `]|` + pctPattern + `)*)*`
+	case '?':
+		return `(?:\?(?:[` + unreservedClass + queryClass + `&]|` + pctPattern + `)*)?`
+	default:
+		panic("unreachable")
+	}
+}
+
+// matchExpression stores the values of the variables in expr
+// matched by the expansion s into values.
+// It reports whether s is a valid expansion of expr.
+func matchExpression(values map[string]Value, expr *Expression, s string) bool {
+	if s == "" {
+		return true
+	}
+	if expr.Operator != 0 && expr.Operator != '+' {
+		s = s[1:]
+	}
+	if opUsesNames(expr.Operator) {
+		return matchNamedExpression(values, expr, s)
+	}
+
+	if len(expr.Vars) == 1 && !expr.Vars[0].Explode {
+		if expr.Operator == '/' && strings.Contains(s, "/") {
+			// A slash inside a path segment value is always percent-encoded.
+			return false
+		}
+		values[expr.Vars[0].Name] = Value{items: splitDecode(s, ',')}
+		return true
+	}
+	items := strings.Split(s, string(opSep(expr.Operator)))
+	for i, spec := range expr.Vars {
+		if i >= len(items) {
+			break
+		}
+		if spec.Explode {
+			values[spec.Name] = explodedValue(items[i:])
+			return true
+		}
+		values[spec.Name] = Value{items: splitDecode(items[i], ',')}
+	}
+	return len(items) <= len(expr.Vars)
+}
+
+// matchNamedExpression is the part of matchExpression
+// that handles the operators that use (name, value) pairs.
+func matchNamedExpression(values map[string]Value, expr *Expression, s string) bool {
+	var collector *VarSpec
+	for i := range expr.Vars {
+		if expr.Vars[i].Explode {
+			if collector != nil {
+				collector = nil
+				break
+			}
+			collector = &expr.Vars[i]
+		}
+	}
+
+	for _, item := range strings.Split(s, string(opSep(expr.Operator))) {
+		name, value, hasValue := strings.Cut(item, "=")
+		if !hasValue && expr.Operator != ';' {
+			return false
+		}
+		spec := findVarSpec(expr.Vars, name)
+		switch {
+		case spec != nil && !spec.Explode:
+			if _, dup := values[name]; dup {
+				return false
+			}
+			values[name] = Value{items: splitDecode(value, ',')}
+		case spec != nil && spec.Explode:
+			v := values[name]
+			if v.keys != nil {
+				return false
+			}
+			v.items = append(v.items, percentDecode(value))
+			values[name] = v
+		case collector != nil:
+			v := values[collector.Name]
+			if v.keys == nil && len(v.items) > 0 {
+				return false
+			}
+			v.keys = append(v.keys, percentDecode(name))
+			v.items = append(v.items, percentDecode(value))
+			values[collector.Name] = v
+		case expr.Operator == '?' || expr.Operator == '&':
+			// Ignore unknown query parameters.
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func findVarSpec(vars []VarSpec, name string) *VarSpec {
+	for i := range vars {
+		if vars[i].Name == name {
+			return &vars[i]
+		}
+	}
+	return nil
+}
+
+// explodedValue returns the value of an exploded variable
+// in an expression that does not use (name, value) pairs.
+func explodedValue(items []string) Value {
+	for _, item := range items {
+		if !strings.Contains(item, "=") {
+			v := Value{items: make([]string, len(items))}
+			for i, item := range items {
+				v.items[i] = percentDecode(item)
+			}
+			return v
+		}
+	}
+	v := Value{
+		keys:  make([]string, len(items)),
+		items: make([]string, len(items)),
+	}
+	for i, item := range items {
+		k, elem, _ := strings.Cut(item, "=")
+		v.keys[i] = percentDecode(k)
+		v.items[i] = percentDecode(elem)
+	}
+	return v
+}
+
+func splitDecode(s string, sep byte) []string {
+	items := strings.Split(s, string(sep))
+	for i := range items {
+		items[i] = percentDecode(items[i])
+	}
+	return items
+}
+
+// percentDecode decodes the percent-encoded octets in s.
+// Malformed escapes are left as-is.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	sb := new(strings.Builder)
+	sb.Grow(len(s))
+	for len(s) > 0 {
+		if pct, rest, ok := cutPercentEscape(s); ok {
+			sb.WriteByte(unhex(pct[1])<<4 | unhex(pct[2]))
+			s = rest
+			continue
+		}
+		sb.WriteByte(s[0])
+		s = s[1:]
+	}
+	return sb.String()
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 0xa
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 0xa
+	default:
+		return 0
+	}
+}
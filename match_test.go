@@ -0,0 +1,293 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+var matchTests = []struct {
+	template string
+	uri      string
+	want     map[string]Value
+}{
+	{
+		template: "/users/{id}/posts{?page,limit}",
+		uri:      "/users/42/posts?page=2",
+		want: map[string]Value{
+			"id":   {items: []string{"42"}},
+			"page": {items: []string{"2"}},
+		},
+	},
+	{
+		template: "/users/{id}/posts{?page,limit}",
+		uri:      "/users/42/posts?limit=10&page=2&utm_source=mail",
+		want: map[string]Value{
+			"id":    {items: []string{"42"}},
+			"page":  {items: []string{"2"}},
+			"limit": {items: []string{"10"}},
+		},
+	},
+	{
+		template: "/users/{id}/posts{?page,limit}",
+		uri:      "/users/42/posts",
+		want: map[string]Value{
+			"id": {items: []string{"42"}},
+		},
+	},
+	{
+		template: "{hello}",
+		uri:      "Hello%20World%21",
+		want: map[string]Value{
+			"hello": {items: []string{"Hello World!"}},
+		},
+	},
+	{
+		template: "{x,y}",
+		uri:      "1024,768",
+		want: map[string]Value{
+			"x": {items: []string{"1024"}},
+			"y": {items: []string{"768"}},
+		},
+	},
+	{
+		template: "{list}",
+		uri:      "red,green,blue",
+		want: map[string]Value{
+			"list": {items: []string{"red", "green", "blue"}},
+		},
+	},
+	{
+		template: "{+path}/here",
+		uri:      "/foo/bar/here",
+		want: map[string]Value{
+			"path": {items: []string{"/foo/bar"}},
+		},
+	},
+	{
+		template: "X{#hello}",
+		uri:      "X#Hello%20World!",
+		want: map[string]Value{
+			"hello": {items: []string{"Hello World!"}},
+		},
+	},
+	{
+		template: "www{.dom*}",
+		uri:      "www.example.com",
+		want: map[string]Value{
+			"dom": {items: []string{"example", "com"}},
+		},
+	},
+	{
+		template: "{/var,x}/here",
+		uri:      "/value/1024/here",
+		want: map[string]Value{
+			"var": {items: []string{"value"}},
+			"x":   {items: []string{"1024"}},
+		},
+	},
+	{
+		template: "{/count*}",
+		uri:      "/one/two/three",
+		want: map[string]Value{
+			"count": {items: []string{"one", "two", "three"}},
+		},
+	},
+	{
+		template: "{;x,y,empty}",
+		uri:      ";x=1024;y=768;empty",
+		want: map[string]Value{
+			"x":     {items: []string{"1024"}},
+			"y":     {items: []string{"768"}},
+			"empty": {items: []string{""}},
+		},
+	},
+	{
+		template: "{;count*}",
+		uri:      ";count=one;count=two;count=three",
+		want: map[string]Value{
+			"count": {items: []string{"one", "two", "three"}},
+		},
+	},
+	{
+		template: "{keys*}",
+		uri:      "semi=%3B,dot=.,comma=%2C",
+		want: map[string]Value{
+			"keys": {
+				keys:  []string{"semi", "dot", "comma"},
+				items: []string{";", ".", ","},
+			},
+		},
+	},
+	{
+		template: "/search{?q,params*}",
+		uri:      "/search?q=go&sort=new&page=2",
+		want: map[string]Value{
+			"q": {items: []string{"go"}},
+			"params": {
+				keys:  []string{"sort", "page"},
+				items: []string{"new", "2"},
+			},
+		},
+	},
+	{
+		template: "?fixed=yes{&x}",
+		uri:      "?fixed=yes&x=1024",
+		want: map[string]Value{
+			"x": {items: []string{"1024"}},
+		},
+	},
+	{
+		template: "/search{?q}{&page}",
+		uri:      "/search?q=go&page=2",
+		want: map[string]Value{
+			"q":    {items: []string{"go"}},
+			"page": {items: []string{"2"}},
+		},
+	},
+	{
+		template: "/search{?q}{&page}",
+		uri:      "/search?page=2&sort=new&q=go",
+		want: map[string]Value{
+			"q":    {items: []string{"go"}},
+			"page": {items: []string{"2"}},
+		},
+	},
+	{
+		template: "/search{?q}{&page}",
+		uri:      "/search&page=2",
+		want: map[string]Value{
+			"page": {items: []string{"2"}},
+		},
+	},
+	{
+		template: "/search{?q}{&page}",
+		uri:      "/search?q=a:b@c/d?e&page=(2)&utm=x/y;z!",
+		want: map[string]Value{
+			"q":    {items: []string{"a:b@c/d?e"}},
+			"page": {items: []string{"(2)"}},
+		},
+	},
+	{
+		template: "/search{?q}",
+		uri:      "/search?q=a+b&next=http://example.com/",
+		want: map[string]Value{
+			"q": {items: []string{"a+b"}},
+		},
+	},
+	{
+		template: "{?q}",
+		uri:      "?q=%2B1$*'",
+		want: map[string]Value{
+			"q": {items: []string{"+1$*'"}},
+		},
+	},
+	{
+		template: "/search{?q}{&page}",
+		uri:      "/search",
+		want:     map[string]Value{},
+	},
+	{
+		template: "{/path}{?q}",
+		uri:      "/foo?q=bar",
+		want: map[string]Value{
+			"path": {items: []string{"foo"}},
+			"q":    {items: []string{"bar"}},
+		},
+	},
+}
+
+func TestMatch(t *testing.T) {
+	for _, test := range matchTests {
+		tmpl, err := Parse(test.template)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.template, err)
+			continue
+		}
+		got, err := tmpl.Match(test.uri)
+		if err != nil {
+			t.Errorf("Parse(%q).Match(%q): %v", test.template, test.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q).Match(%q) = %#v; want %#v", test.template, test.uri, got, test.want)
+		}
+	}
+}
+
+func TestMatchNoMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		uri      string
+	}{
+		{"/users/{id}", "/posts/42"},
+		{"/users/{id}", "/users/4/2"},
+		{"{/var}", "/foo/bar"},
+		{"{;x}", ";y=1"},
+		{"{x,y}", "1,2,3"},
+		{"/search{?q}{&page}", "/search?page=1&page=2"},
+	}
+	for _, test := range tests {
+		tmpl, err := Parse(test.template)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.template, err)
+			continue
+		}
+		if got, err := tmpl.Match(test.uri); !errors.Is(err, ErrNoMatch) {
+			t.Errorf("Parse(%q).Match(%q) = %v, %v; want _, %v", test.template, test.uri, got, err, ErrNoMatch)
+		}
+	}
+}
+
+func TestMatchAmbiguous(t *testing.T) {
+	tests := []string{
+		"{a}{b}",
+		"{+a}{/b}",
+		"{/a*,b}",
+		"{?q}{/path}",
+	}
+	for _, template := range tests {
+		tmpl, err := Parse(template)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", template, err)
+			continue
+		}
+		if _, err := tmpl.Match(""); err == nil || errors.Is(err, ErrNoMatch) {
+			t.Errorf("Parse(%q).Match(\"\") error = %v; want ambiguity error", template, err)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	v := Value{items: []string{"semi", ";", "dot", "."}}
+	if got, want := v.String(), "semi,;,dot,."; got != want {
+		t.Errorf("String() = %q; want %q", got, want)
+	}
+	if got, want := v.Map(), map[string]string{"semi": ";", "dot": "."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v; want %v", got, want)
+	}
+
+	v = Value{keys: []string{"semi", "dot"}, items: []string{";", "."}}
+	if got, want := v.List(), []string{"semi", ";", "dot", "."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %q; want %q", got, want)
+	}
+	if got, want := v.Map(), map[string]string{"semi": ";", "dot": "."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Map() = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mux provides an HTTP request multiplexer
+// that routes requests using URI templates.
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/uritemplate"
+)
+
+// Mux is an HTTP request multiplexer.
+// It matches the URL of each incoming request
+// against a list of registered URI templates
+// and calls the handler for the template that most closely matches the URL.
+// The zero value is an empty Mux ready to use.
+//
+// # Patterns
+//
+// Patterns have the form "[METHOD ]TEMPLATE".
+// For example, "GET /repos/{owner}/{repo}/issues{?state}"
+// matches GET and HEAD requests for the issues of any repository,
+// with or without a state query parameter.
+// A pattern without a method matches requests with any method.
+// See [uritemplate.Template.Match] for how URLs are matched against templates.
+// Query parameters that are not named in the template are ignored.
+// If the template has no form-style query expression,
+// then the query is ignored entirely.
+//
+// If more than one template matches a request,
+// then the template with the most literal characters is used.
+// If more than one template has the same number of literal characters,
+// then the template that was registered first is used.
+type Mux struct {
+	mu sync.RWMutex
+	// routes is replaced rather than modified when a route is registered
+	// so that ServeHTTP can iterate over it without holding mu.
+	routes []*route
+	names  map[string]*route
+}
+
+type route struct {
+	method   string
+	template *uritemplate.Template
+	handler  http.Handler
+
+	// specificity is the number of literal characters in the template.
+	specificity int
+	// matchesQuery is true if the template has a form-style query expression,
+	// so the query must match along with the path.
+	matchesQuery bool
+}
+
+// Handle registers the handler for the given pattern.
+// Handle panics if the pattern is invalid
+// or its template cannot be matched reliably.
+func (mux *Mux) Handle(pattern string, handler http.Handler) {
+	mux.handle("", pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern.
+// HandleFunc panics if the pattern is invalid
+// or its template cannot be matched reliably.
+func (mux *Mux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	mux.handle("", pattern, http.HandlerFunc(handler))
+}
+
+// HandleNamed registers the handler for the given pattern
+// and associates the pattern's template with the given name
+// for use with [Mux.URL].
+// HandleNamed panics if the pattern is invalid,
+// its template cannot be matched reliably,
+// or the name is already in use.
+func (mux *Mux) HandleNamed(name, pattern string, handler http.Handler) {
+	if name == "" {
+		panic("mux: empty route name")
+	}
+	mux.handle(name, pattern, handler)
+}
+
+func (mux *Mux) handle(name, pattern string, handler http.Handler) {
+	if handler == nil {
+		panic("mux: nil handler")
+	}
+	r := &route{handler: handler}
+	tmpl := pattern
+	if i := strings.IndexByte(pattern, ' '); i >= 0 {
+		r.method, tmpl = pattern[:i], strings.TrimLeft(pattern[i+1:], " ")
+		if r.method == "" {
+			panic(fmt.Sprintf("mux: pattern %q: empty method", pattern))
+		}
+	}
+	var err error
+	r.template, err = uritemplate.Parse(tmpl)
+	if err != nil {
+		panic(fmt.Sprintf("mux: pattern %q: %v", pattern, err))
+	}
+	if _, err := r.template.Match(""); err != nil && !errors.Is(err, uritemplate.ErrNoMatch) {
+		panic(fmt.Sprintf("mux: pattern %q: %v", pattern, err))
+	}
+	r.specificity = countLiteralChars(tmpl)
+	for _, v := range r.template.Variables() {
+		for _, ref := range v.Refs {
+			if ref.Operator == uritemplate.OpQuery || ref.Operator == uritemplate.OpQueryContinuation {
+				r.matchesQuery = true
+			}
+		}
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	if name != "" {
+		if mux.names[name] != nil {
+			panic(fmt.Sprintf("mux: multiple registrations for route name %q", name))
+		}
+		if mux.names == nil {
+			mux.names = make(map[string]*route)
+		}
+		mux.names[name] = r
+	}
+	routes := make([]*route, len(mux.routes), len(mux.routes)+1)
+	copy(routes, mux.routes)
+	routes = append(routes, r)
+	// Keep routes ordered by decreasing specificity
+	// so that the first match is the best match.
+	sort.SliceStable(routes, func(i, j int) bool {
+		return routes[i].specificity > routes[j].specificity
+	})
+	mux.routes = routes
+}
+
+// countLiteralChars returns the number of bytes in a template
+// that are outside of expressions.
+func countLiteralChars(tmpl string) int {
+	n := 0
+	for len(tmpl) > 0 {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			return n + len(tmpl)
+		}
+		n += start
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			return n
+		}
+		tmpl = tmpl[start+end+1:]
+	}
+	return n
+}
+
+// ServeHTTP dispatches the request to the handler
+// whose template most closely matches the request URL.
+// If no template matches, ServeHTTP replies with 404 Not Found.
+// If templates match but none of them permit the request method,
+// ServeHTTP replies with 405 Method Not Allowed.
+func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	uri := path
+	if r.URL.RawQuery != "" {
+		uri += "?" + r.URL.RawQuery
+	}
+
+	mux.mu.RLock()
+	routes := mux.routes
+	mux.mu.RUnlock()
+
+	var allowed []string
+	for _, rt := range routes {
+		values, err := rt.template.Match(uri)
+		if err != nil && uri != path && !rt.matchesQuery {
+			values, err = rt.template.Match(path)
+		}
+		if err != nil {
+			continue
+		}
+		if !rt.allows(r.Method) {
+			allowed = appendMethod(allowed, rt.method)
+			if rt.method == http.MethodGet {
+				allowed = appendMethod(allowed, http.MethodHead)
+			}
+			continue
+		}
+		ctx := context.WithValue(r.Context(), varsKey{}, values)
+		rt.handler.ServeHTTP(w, r.WithContext(ctx))
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (rt *route) allows(method string) bool {
+	return rt.method == "" ||
+		rt.method == method ||
+		rt.method == http.MethodGet && method == http.MethodHead
+}
+
+// URL expands the template of the route registered with the given name.
+// See [uritemplate.Expand] for how data is interpreted.
+func (mux *Mux) URL(name string, data any) (string, error) {
+	mux.mu.RLock()
+	rt := mux.names[name]
+	mux.mu.RUnlock()
+	if rt == nil {
+		return "", fmt.Errorf("mux: no route named %q", name)
+	}
+	return rt.template.Expand(data)
+}
+
+// appendMethod appends method to the list of methods
+// if it is not already present.
+func appendMethod(methods []string, method string) []string {
+	for _, m := range methods {
+		if m == method {
+			return methods
+		}
+	}
+	return append(methods, method)
+}
+
+type varsKey struct{}
+
+// Vars returns the variables matched by the route
+// that is handling the request.
+// Vars returns nil if the request was not routed by a [Mux].
+func Vars(r *http.Request) map[string]uritemplate.Value {
+	values, _ := r.Context().Value(varsKey{}).(map[string]uritemplate.Value)
+	return values
+}
+
+// Unmarshal stores the variables matched by the route
+// that is handling the request in the value pointed to by v.
+// See [uritemplate.Unmarshal] for details.
+func Unmarshal(r *http.Request, v any) error {
+	return uritemplate.Unmarshal(Vars(r), v)
+}
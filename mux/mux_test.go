@@ -0,0 +1,240 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mux
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestMux() *Mux {
+	mux := new(Mux)
+	reply := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+			for _, k := range []string{"owner", "repo", "state", "id", "q", "page"} {
+				if v, ok := Vars(r)[k]; ok {
+					fmt.Fprintf(w, " %s=%v", k, v)
+				}
+			}
+		})
+	}
+	mux.HandleNamed("issues", "GET /repos/{owner}/{repo}/issues{?state}", reply("issues"))
+	mux.Handle("POST /repos/{owner}/{repo}/issues", reply("create"))
+	mux.Handle("/repos/{owner}/{repo}", reply("repo"))
+	mux.Handle("/repos/zombiezen/{repo}", reply("zombiezen"))
+	mux.Handle("DELETE /items/{id}", reply("delete"))
+	mux.Handle("GET /search{?q}{&page}", reply("search"))
+	return mux
+}
+
+func TestMux(t *testing.T) {
+	tests := []struct {
+		method   string
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{
+			method:   http.MethodGet,
+			target:   "/repos/foo/bar/issues",
+			wantCode: http.StatusOK,
+			wantBody: "issues owner=foo repo=bar",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/repos/foo/bar/issues?state=open&sort=new",
+			wantCode: http.StatusOK,
+			wantBody: "issues owner=foo repo=bar state=open",
+		},
+		{
+			method:   http.MethodHead,
+			target:   "/repos/foo/bar/issues",
+			wantCode: http.StatusOK,
+		},
+		{
+			method:   http.MethodPost,
+			target:   "/repos/foo/bar/issues?x=1",
+			wantCode: http.StatusOK,
+			wantBody: "create owner=foo repo=bar",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/repos/foo/bar",
+			wantCode: http.StatusOK,
+			wantBody: "repo owner=foo repo=bar",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/repos/zombiezen/uritemplate",
+			wantCode: http.StatusOK,
+			wantBody: "zombiezen repo=uritemplate",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/search?page=2&q=go",
+			wantCode: http.StatusOK,
+			wantBody: "search q=go page=2",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/search?q=a+b&page=2",
+			wantCode: http.StatusOK,
+			wantBody: "search q=a+b page=2",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/search?q=http://x&page=3",
+			wantCode: http.StatusOK,
+			wantBody: "search q=http://x page=3",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/search?q=x&utm=a/b",
+			wantCode: http.StatusOK,
+			wantBody: "search q=x",
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/search?q=%zz",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/items/42",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			method:   http.MethodGet,
+			target:   "/nope",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	mux := newTestMux()
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+		if rec.Code != test.wantCode {
+			t.Errorf("%s %s status = %d; want %d", test.method, test.target, rec.Code, test.wantCode)
+		}
+		if test.wantBody != "" && rec.Body.String() != test.wantBody {
+			t.Errorf("%s %s body = %q; want %q", test.method, test.target, rec.Body.String(), test.wantBody)
+		}
+	}
+}
+
+func TestMuxMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		method    string
+		target    string
+		wantAllow string
+	}{
+		{http.MethodGet, "/items/42", "DELETE"},
+		{http.MethodPut, "/repos/foo/bar/issues", "GET, HEAD, POST"},
+	}
+	mux := newTestMux()
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s status = %d; want %d", test.method, test.target, rec.Code, http.StatusMethodNotAllowed)
+		}
+		if got := rec.Header().Get("Allow"); got != test.wantAllow {
+			t.Errorf("%s %s Allow = %q; want %q", test.method, test.target, got, test.wantAllow)
+		}
+	}
+}
+
+func TestMuxConcurrentHandle(t *testing.T) {
+	// Registering routes while serving requests should not race.
+	mux := newTestMux()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			mux.Handle(fmt.Sprintf("GET /generated/%d/{id}", i), http.NotFoundHandler())
+		}
+	}()
+	for serving := true; serving; {
+		select {
+		case <-done:
+			serving = false
+		default:
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/repos/foo/bar", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /repos/foo/bar status = %d; want %d", rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestMuxURL(t *testing.T) {
+	mux := newTestMux()
+	got, err := mux.URL("issues", map[string]string{
+		"owner": "foo",
+		"repo":  "bar",
+		"state": "closed",
+	})
+	if want := "/repos/foo/bar/issues?state=closed"; got != want || err != nil {
+		t.Errorf("mux.URL(\"issues\", ...) = %q, %v; want %q, <nil>", got, err, want)
+	}
+	if _, err := mux.URL("bogus", nil); err == nil {
+		t.Error("mux.URL(\"bogus\", nil) did not return an error")
+	}
+}
+
+func TestMuxUnmarshal(t *testing.T) {
+	mux := new(Mux)
+	var got struct {
+		Owner string
+		State []string
+	}
+	mux.HandleFunc("/repos/{owner}{?state*}", func(w http.ResponseWriter, r *http.Request) {
+		if err := Unmarshal(r, &got); err != nil {
+			t.Error(err)
+		}
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/repos/foo?state=open&state=closed", nil))
+	if got.Owner != "foo" || len(got.State) != 2 || got.State[0] != "open" || got.State[1] != "closed" {
+		t.Errorf("got = %+v; want {Owner:foo State:[open closed]}", got)
+	}
+}
+
+func TestMuxPanics(t *testing.T) {
+	tests := []func(mux *Mux){
+		func(mux *Mux) { mux.Handle("/{", http.NotFoundHandler()) },
+		func(mux *Mux) { mux.Handle("/{a}{b}", http.NotFoundHandler()) },
+		func(mux *Mux) { mux.Handle("/", nil) },
+		func(mux *Mux) {
+			mux.HandleNamed("x", "/a", http.NotFoundHandler())
+			mux.HandleNamed("x", "/b", http.NotFoundHandler())
+		},
+	}
+	for i, f := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("tests[%d] did not panic", i)
+				}
+			}()
+			f(new(Mux))
+		}()
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PartialExpand expands the variables in the template that are defined by data
+// and returns a new template in which the remaining variables are left as expressions.
+// Data is interpreted as in [Expand],
+// along with any defaults bound by [Template.With].
+// The returned template uses the same [Expander] options as t
+// and has no defaults.
+//
+// An expression whose variables are all defined is expanded as usual,
+// and an expression whose variables are all undefined is left as-is.
+// An expression with both defined and undefined variables is split:
+// for example, {?a,b} with only a defined becomes "?a=1{&b}"
+// and {/a,b,c} with only b defined becomes "{/a}/2{/c}".
+// Form-style query expressions place the defined variables first,
+// so they may change the order of query parameters.
+// Simple string, reserved, and fragment expressions cannot be split
+// because their expansions do not mark where each variable begins,
+// so PartialExpand returns an error if such an expression
+// has both defined and undefined variables.
+//
+// Apostrophes in expanded values are percent-encoded,
+// since they are not allowed in template literals.
+func (t *Template) PartialExpand(data any) (*Template, error) {
+	e := t.opts
+	// Undefined variables are expected: they are the ones left in the template.
+	e.Strict = false
+	x := &expansion{ctx: context.Background(), data: reflect.ValueOf(t.withDefaults(data))}
+	sb := new(strings.Builder)
+	for _, p := range t.parts {
+		if p.expr == nil {
+			sb.WriteString(t.s[p.pos:p.end])
+			continue
+		}
+		if err := e.partialExpandExpression(sb, p.expr, x); err != nil {
+			return nil, fmt.Errorf("partially expand uri template %q: %w", t.s, err)
+		}
+	}
+	return t.opts.Parse(sb.String())
+}
+
+func (e *Expander) partialExpandExpression(sb *strings.Builder, expr *Expression, x *expansion) error {
+	// Expand each variable on its own to find out which ones are defined.
+	// Each expansion starts with the operator's prefix, if any.
+	expanded := make([]string, len(expr.Vars))
+	defined := make([]bool, len(expr.Vars))
+	known := 0
+	for i, spec := range expr.Vars {
+		var buf buffer
+		undefined, err := e.expandVariable(&buf, expr.Operator, true, x, spec)
+		if err != nil {
+			return &ValueError{Name: spec.Name, Err: err}
+		}
+		if !undefined {
+			expanded[i] = string(buf)
+			defined[i] = true
+			known++
+		}
+	}
+
+	switch {
+	case known == 0:
+		sb.WriteString(expr.String())
+		return nil
+	case known == len(expr.Vars):
+		var buf buffer
+		if err := e.expandExpression(&buf, expr, x); err != nil {
+			return err
+		}
+		writeTemplateLiteral(sb, string(buf))
+		return nil
+	}
+
+	switch expr.Operator {
+	case OpLabel, OpPathSegment, OpPathParameter:
+		// The prefix and the separator are the same,
+		// so each variable's expansion can stand alone.
+		var missing []VarSpec
+		for i, spec := range expr.Vars {
+			if !defined[i] {
+				missing = append(missing, spec)
+				continue
+			}
+			if len(missing) > 0 {
+				sb.WriteString((&Expression{Operator: expr.Operator, Vars: missing}).String())
+				missing = missing[:0]
+			}
+			writeTemplateLiteral(sb, expanded[i])
+		}
+		if len(missing) > 0 {
+			sb.WriteString((&Expression{Operator: expr.Operator, Vars: missing}).String())
+		}
+	case OpQuery, OpQueryContinuation:
+		first := true
+		var missing []VarSpec
+		for i, spec := range expr.Vars {
+			if !defined[i] {
+				missing = append(missing, spec)
+				continue
+			}
+			s := expanded[i]
+			if !first || expr.Operator == OpQueryContinuation {
+				s = "&" + s[1:]
+			}
+			writeTemplateLiteral(sb, s)
+			first = false
+		}
+		sb.WriteString((&Expression{Operator: OpQueryContinuation, Vars: missing}).String())
+	default:
+		return fmt.Errorf("expression %s cannot be partially expanded: it has both defined and undefined variables", expr)
+	}
+	return nil
+}
+
+// writeTemplateLiteral writes the expanded URI s to sb
+// as a template literal that expands to s.
+func writeTemplateLiteral(sb *strings.Builder, s string) {
+	for {
+		i := strings.IndexByte(s, '\'')
+		if i == -1 {
+			sb.WriteString(s)
+			return
+		}
+		sb.WriteString(s[:i])
+		sb.WriteString("%27")
+		s = s[i+1:]
+	}
+}
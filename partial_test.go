@@ -0,0 +1,99 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPartialExpand(t *testing.T) {
+	data := map[string]any{
+		"tenant": "acme",
+		"region": "us-east",
+		"a":      1,
+		"c":      3,
+		"list":   []string{"x", "y"},
+		"quote":  "it's",
+		"empty":  "",
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"https://{tenant}.{region}.example.com/items/{id}", "https://acme.us-east.example.com/items/{id}"},
+		{"/items{?a,b}", "/items?a=1{&b}"},
+		{"/items{?b,a,c,d}", "/items?a=1&c=3{&b,d}"},
+		{"/items?x=y{&b,a}", "/items?x=y&a=1{&b}"},
+		{"/items{?b,d}", "/items{?b,d}"},
+		{"{/a,b,c}", "/1{/b}/3"},
+		{"{/b,a,d:3,list*}", "{/b}/1{/d:3}/x/y"},
+		{"{;a,b}", ";a=1{;b}"},
+		{"X{.b,a}", "X{.b}.1"},
+		{"{x,y}", "{x,y}"},
+		{"{a,c}", "1,3"},
+		{"{#a,list}", "#1,x,y"},
+		{"{+quote}/{quote}", "it%27s/it%27s"},
+		{"{a}{empty}{id}", "1{id}"},
+	}
+	for _, test := range tests {
+		tmpl, err := MustParse(test.template).PartialExpand(data)
+		if err != nil {
+			t.Errorf("Parse(%q).PartialExpand(data): %v", test.template, err)
+			continue
+		}
+		if got := tmpl.String(); got != test.want {
+			t.Errorf("Parse(%q).PartialExpand(data) = %q; want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestPartialExpandRoundTrip(t *testing.T) {
+	tmpl := MustParse("https://{host}/{version}/items{/id}{?q,page,tags*}")
+	first := map[string]any{"host": "example.com", "page": 2}
+	second := map[string]any{"version": "v1", "id": 7, "q": "go lang", "tags": []string{"a", "b"}}
+
+	partial, err := tmpl.PartialExpand(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := partial.Expand(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/v1/items/7?page=2&q=go%20lang&tags=a&tags=b"; got != want {
+		t.Errorf("PartialExpand(first).Expand(second) = %q; want %q", got, want)
+	}
+}
+
+func TestPartialExpandErrors(t *testing.T) {
+	tests := []string{
+		"{a,b}",
+		"{+b,a}",
+		"{#a,b}",
+	}
+	for _, template := range tests {
+		if got, err := MustParse(template).PartialExpand(map[string]any{"a": 1}); err == nil {
+			t.Errorf("Parse(%q).PartialExpand(data) = %q, <nil>; want error", template, got)
+		}
+	}
+
+	_, err := MustParse("{?a,b}").PartialExpand(map[string]any{"a": failingMarshaler{}})
+	if !errors.Is(err, errMarshal) {
+		t.Errorf("PartialExpand with failing value error = %v; want %v", err, errMarshal)
+	}
+}
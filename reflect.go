@@ -17,145 +17,227 @@
 package uritemplate
 
 import (
+	"context"
 	"encoding"
 	"errors"
 	"fmt"
 	"reflect"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 	"unicode/utf8"
 )
 
-func expandVariable(sb *strings.Builder, op byte, first bool, data reflect.Value, varName, modifier string) (stillFirst bool, err error) {
-	vk, val := kindOf(lookupKey(data, varName))
+// An expansion is the state of a single expansion of a template.
+type expansion struct {
+	ctx  context.Context
+	data reflect.Value
+	// lazy holds the results of lazy values by variable name
+	// so that each lazy value is called at most once per expansion.
+	lazy map[string]lazyResult
+}
+
+type lazyResult struct {
+	v   reflect.Value
+	err error
+}
+
+// resolve returns the result of calling v if v is a lazy value
+// (a func() (T, error) or a func(context.Context) (T, error)).
+// Otherwise, resolve returns v unchanged.
+// name identifies v for memoization.
+func (x *expansion) resolve(name string, v reflect.Value) (reflect.Value, error) {
+	fn := v
+	for fn.Kind() == reflect.Interface && !fn.IsNil() {
+		fn = fn.Elem()
+	}
+	if fn.Kind() != reflect.Func || !isLazy(fn.Type()) {
+		return v, nil
+	}
+	if fn.IsNil() {
+		return reflect.Value{}, nil
+	}
+	if r, ok := x.lazy[name]; ok {
+		return r.v, r.err
+	}
+	var out []reflect.Value
+	if fn.Type().NumIn() == 0 {
+		out = fn.Call(nil)
+	} else {
+		out = fn.Call([]reflect.Value{reflect.ValueOf(x.ctx)})
+	}
+	r := lazyResult{v: out[0]}
+	if !out[1].IsNil() {
+		r.err = out[1].Interface().(error)
+	}
+	if x.lazy == nil {
+		x.lazy = make(map[string]lazyResult)
+	}
+	x.lazy[name] = r
+	return r.v, r.err
+}
+
+// isLazy reports whether t is a func() (T, error)
+// or a func(context.Context) (T, error).
+func isLazy(t reflect.Type) bool {
+	if t.NumOut() != 2 || t.Out(1) != errorType || t.IsVariadic() {
+		return false
+	}
+	switch t.NumIn() {
+	case 0:
+		return true
+	case 1:
+		return t.In(0) == contextType
+	default:
+		return false
+	}
+}
+
+func (e *Expander) expandVariable(buf *buffer, op Operator, first bool, x *expansion, spec VarSpec) (stillFirst bool, err error) {
+	varName := spec.Name
+	var v reflect.Value
+	var opts fieldOptions
+	if e.NestedNames {
+		v, opts, err = x.lookupPath(varName, e.naming())
+	} else {
+		v, opts = lookupKey(x.data, varName, e.naming())
+	}
+	if err == nil {
+		v, err = x.resolve(varName, v)
+	}
+	if err != nil {
+		return first, err
+	}
+	switch {
+	case opts.explode:
+		spec.Explode = true
+	case opts.noExplode:
+		spec.Explode = false
+	}
+	vk, val := kindOf(v)
 	if vk == 0 {
+		if e.Strict {
+			return first, ErrUndefined
+		}
 		return first, nil
 	}
 
+	start := len(*buf)
 	sep := opSep(op)
 	if first {
 		if op != 0 && op != '+' {
-			sb.WriteByte(op)
+			buf.WriteByte(byte(op))
 		}
 	} else {
-		sb.WriteByte(sep)
+		buf.WriteByte(sep)
 	}
 
-	switch {
-	case vk == scalarKind:
-		s, err := coerceString(val)
-		writeVarNamePrefix(sb, op, varName, s == "")
+	if vk == scalarKind {
+		s, err := e.coerceString(val)
+		writeVarNamePrefix(buf, op, varName, s == "")
 		if err != nil {
 			return false, err
 		}
-		s = modify(s, modifier)
-		writeValue(sb, op, s)
-	case vk == listKind && modifier != "*":
-		empty := isEmpty(val)
-		writeVarNamePrefix(sb, op, varName, empty)
-		if !empty {
-			for i, n, defined := 0, val.Len(), false; i < n; i++ {
-				elemValue, _ := followIndirection(val.Index(i))
-				if !elemValue.IsValid() {
-					continue
-				}
-				s, err := coerceString(elemValue)
-				if err != nil {
-					return false, err
-				}
+		s = truncate(s, spec.MaxLength)
+		e.writeValue(buf, op, s)
+		return false, nil
+	}
 
-				if defined {
-					sb.WriteByte(',')
-				}
-				writeValue(sb, op, s)
-				defined = true
-			}
+	w := elementWriter{
+		e:       *e,
+		buf:     *buf,
+		op:      op,
+		name:    varName,
+		vk:      vk,
+		explode: spec.Explode,
+	}
+	err = w.iterateComposite(val)
+	*buf = w.buf
+	switch {
+	case err != nil:
+		return false, err
+	case w.err != nil:
+		return false, w.err
+	case w.defined:
+		return false, nil
+	default:
+		// A composite with no defined elements is undefined.
+		// Remove the separator written above.
+		*buf = (*buf)[:start]
+		if e.Strict {
+			return first, ErrUndefined
 		}
-	case vk == mapKind && modifier != "*":
-		empty := isEmpty(val)
-		writeVarNamePrefix(sb, op, varName, empty)
-		if !empty {
-			defined := false
-			var err error
-			iterateMap(val, func(k string, elemValue reflect.Value) bool {
-				elemValue, _ = followIndirection(elemValue)
-				if !elemValue.IsValid() {
-					return true
-				}
-				var s string
-				s, err = coerceString(elemValue)
-				if err != nil {
-					return false
-				}
+		return first, nil
+	}
+}
 
-				if defined {
-					sb.WriteByte(',')
-				}
-				writeValue(sb, op, k)
-				sb.WriteByte(',')
-				writeValue(sb, op, s)
-				defined = true
-				return true
-			})
-			if err != nil {
-				return false, err
-			}
-		}
-	case vk == listKind && modifier == "*":
-		for i, n, defined := 0, val.Len(), false; i < n; i++ {
-			elemValue, _ := followIndirection(val.Index(i))
-			if !elemValue.IsValid() {
-				continue
-			}
-			s, err := coerceString(elemValue)
-			if err != nil {
-				return false, err
-			}
+// An elementWriter writes the elements of a composite variable value.
+// It holds copies of the Expander and the buffer rather than pointers
+// so that it can be copied to the heap without moving them to the heap.
+type elementWriter struct {
+	e       Expander
+	buf     buffer
+	op      Operator
+	name    string
+	vk      varKind
+	explode bool
 
-			if defined {
-				sb.WriteByte(sep)
-			}
-			writeVarNamePrefix(sb, op, varName, s == "")
-			writeValue(sb, op, s)
-			defined = true
-		}
-	case vk == mapKind && modifier == "*":
-		defined := false
-		var err error
-		iterateMap(val, func(k string, elemValue reflect.Value) bool {
-			elemValue, _ = followIndirection(elemValue)
-			if !elemValue.IsValid() {
-				return true
-			}
-			var s string
-			s, err = coerceString(elemValue)
-			if err != nil {
-				return false
-			}
+	// defined is true if any element has been written.
+	defined bool
+	// err is the first error converting an element to a string.
+	err error
+}
 
-			if defined {
-				sb.WriteByte(sep)
-			}
-			if opUsesNames(op) {
-				writeVarNamePrefix(sb, op, k, s == "")
-			} else {
-				writeValue(sb, op, k)
-				sb.WriteString("=")
-			}
-			writeValue(sb, op, s)
-			defined = true
-			return true
-		})
-		if err != nil {
-			return false, err
+// write writes the element of a composite value with the key k
+// (empty for list elements) and the value v.
+// It reports whether iteration should continue.
+func (w *elementWriter) write(k string, v reflect.Value) bool {
+	s, err := w.e.coerceString(v)
+	if err != nil {
+		w.err = err
+		return false
+	}
+
+	if !w.explode {
+		if w.defined {
+			w.buf.WriteByte(',')
+		} else {
+			writeVarNamePrefix(&w.buf, w.op, w.name, false)
+		}
+		if w.vk == mapKind {
+			w.e.writeValue(&w.buf, w.op, k)
+			w.buf.WriteByte(',')
+		}
+	} else {
+		if w.defined {
+			w.buf.WriteByte(opSep(w.op))
+		}
+		switch {
+		case w.vk == listKind:
+			writeVarNamePrefix(&w.buf, w.op, w.name, s == "")
+		case opUsesNames(w.op):
+			writeVarNamePrefix(&w.buf, w.op, k, s == "")
+		default:
+			w.e.writeValue(&w.buf, w.op, k)
+			w.buf.WriteString("=")
 		}
-	default:
-		panic("unreachable")
 	}
+	w.e.writeValue(&w.buf, w.op, s)
+	w.defined = true
+	return true
+}
 
-	return false, nil
+// toHeap returns a copy of w on the heap
+// that can be captured by the callbacks passed to
+// [ListValuer], [MapValuer], and iterator functions.
+// The compiler assumes that such callbacks escape,
+// so capturing w itself would move it to the heap on every expansion.
+// The caller must copy the state back into w when it is done with the copy.
+func (w *elementWriter) toHeap() *elementWriter {
+	hw := new(elementWriter)
+	*hw = *w
+	return hw
 }
 
 var keyStringPool = sync.Pool{
@@ -165,25 +247,56 @@ var keyStringPool = sync.Pool{
 	},
 }
 
-func lookupKey(composite reflect.Value, key string) reflect.Value {
+// lookupKey returns the element of composite with the given key.
+// If the element is a struct field, then lookupKey also returns its tag options.
+func lookupKey(composite reflect.Value, key string, nm naming) (reflect.Value, fieldOptions) {
 	if !composite.IsValid() {
-		return reflect.Value{}
+		return reflect.Value{}, fieldOptions{}
 	}
 	for {
-		if k := composite.Kind(); k != reflect.Pointer && k != reflect.Interface {
+		typ := composite.Type()
+		k := typ.Kind()
+		if typ == layersType {
+			return lookupLayers(composite.Interface().(Layers), key, nm)
+		}
+		if k == reflect.Pointer && typ.Elem() == layersType {
+			// Look through the pointer rather than using Layers.Lookup,
+			// which does not know the Expander's naming options.
+			if composite.IsNil() {
+				return reflect.Value{}, fieldOptions{}
+			}
+			composite = composite.Elem()
+			continue
+		}
+		if k != reflect.Interface && composite.CanInterface() && implements(typ, sourceType) {
+			if isNilable(k) && composite.IsNil() {
+				return reflect.Value{}, fieldOptions{}
+			}
+			value, ok := composite.Interface().(Source).Lookup(key)
+			if !ok {
+				return reflect.Value{}, fieldOptions{}
+			}
+			return reflect.ValueOf(value), fieldOptions{}
+		}
+		if k != reflect.Pointer && k != reflect.Interface {
 			break
 		}
 		if composite.IsNil() {
-			return reflect.Value{}
+			return reflect.Value{}, fieldOptions{}
 		}
 		composite = composite.Elem()
 	}
 
 	switch composite.Kind() {
 	case reflect.Map:
+		if m, ok := asAnyMap(composite); ok {
+			// Index the common map type directly:
+			// MapIndex copies interface elements to the heap.
+			return reflect.ValueOf(m[key]), fieldOptions{}
+		}
 		keyType := composite.Type().Key()
 		if keyType.Kind() != reflect.String {
-			return reflect.Value{}
+			return reflect.Value{}, fieldOptions{}
 		}
 		keyReflectPtrValue := keyStringPool.Get().(*reflect.Value)
 		keyReflectValue := keyReflectPtrValue.Elem()
@@ -196,52 +309,105 @@ func lookupKey(composite reflect.Value, key string) reflect.Value {
 		}
 		keyReflectValue.SetString("")
 		keyStringPool.Put(keyReflectPtrValue)
-		return result
+		if result.Kind() == reflect.Slice && isMultiValueMap(composite.Type()) && result.Len() == 1 {
+			// Treat a single value from a url.Values-style map as a string.
+			result = result.Index(0)
+		}
+		return result, fieldOptions{}
 	case reflect.Struct:
-		sd := describeStruct(composite.Type())
+		sd := describeStruct(composite.Type(), nm)
 		i, ok := sd.indexLookup[key]
 		if !ok {
-			return reflect.Value{}
+			return reflect.Value{}, fieldOptions{}
+		}
+		f := &sd.fields[i]
+		return f.value(composite), f.fieldOptions
+	case reflect.Slice:
+		if !isPairs(composite.Type()) {
+			return reflect.Value{}, fieldOptions{}
 		}
-		return composite.Field(i)
+		for i, n := 0, composite.Len(); i < n; i++ {
+			if p := composite.Index(i); p.Field(0).String() == key {
+				return p.Field(1), fieldOptions{}
+			}
+		}
+		return reflect.Value{}, fieldOptions{}
 	default:
-		return reflect.Value{}
+		return reflect.Value{}, fieldOptions{}
 	}
 }
 
-func writeVarNamePrefix(sb *strings.Builder, op byte, varName string, empty bool) {
-	if !opUsesNames(op) {
-		return
+// lookupLayers returns the first defined value for key in layers.
+func lookupLayers(layers Layers, key string, nm naming) (reflect.Value, fieldOptions) {
+	for _, layer := range layers {
+		v, opts := lookupKey(reflect.ValueOf(layer), key, nm)
+		if defined, _ := followIndirection(v); defined.IsValid() {
+			return v, opts
+		}
 	}
-	for len(varName) > 0 {
-		if pct, rest, ok := cutPercentEscape(varName); ok {
-			sb.WriteString(pct)
-			varName = rest
-			continue
+	return reflect.Value{}, fieldOptions{}
+}
+
+// lookupPath is like lookupKey on the expansion's data,
+// but if a composite does not contain the rest of name,
+// then a dotted name navigates through nested composites.
+// Lazy values are resolved along the way.
+func (x *expansion) lookupPath(name string, nm naming) (reflect.Value, fieldOptions, error) {
+	composite := x.data
+	rest := name
+	for {
+		if v, opts := lookupKey(composite, rest, nm); v.IsValid() {
+			return v, opts, nil
 		}
-		c, size := utf8.DecodeRuneInString(varName)
-		if literalNeedsPercentEscape(c) {
-			percentEscape(sb, varName[:size])
-		} else {
-			sb.WriteString(varName[:size])
+		head, tail, ok := strings.Cut(rest, ".")
+		if !ok {
+			return reflect.Value{}, fieldOptions{}, nil
+		}
+		next, _ := lookupKey(composite, head, nm)
+		next, err := x.resolve(name[:len(name)-len(tail)-1], next)
+		if err != nil {
+			return reflect.Value{}, fieldOptions{}, err
 		}
-		varName = varName[size:]
+		composite, rest = next, tail
+	}
+}
+
+// implements reports whether t implements the interface type u,
+// which must have at least one method.
+// It is faster than t.Implements(u) for types without methods.
+func implements(t, u reflect.Type) bool {
+	return t.NumMethod() > 0 && t.Implements(u)
+}
+
+func isNilable(k reflect.Kind) bool {
+	switch k {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer, reflect.Slice:
+		return true
+	default:
+		return false
 	}
+}
+
+func writeVarNamePrefix(buf *buffer, op Operator, varName string, empty bool) {
+	if !opUsesNames(op) {
+		return
+	}
+	writeLiteral(buf, varName)
 	if !empty || op == '?' || op == '&' {
-		sb.WriteString("=")
+		buf.WriteString("=")
 	}
 }
 
-func opUsesNames(op byte) bool {
+func opUsesNames(op Operator) bool {
 	return op == ';' || op == '?' || op == '&'
 }
 
-func opSep(op byte) byte {
+func opSep(op Operator) byte {
 	switch op {
 	case 0, '+', '#':
 		return ','
 	case '.', '/', ';':
-		return op
+		return byte(op)
 	case '?', '&':
 		return '&'
 	default:
@@ -249,35 +415,41 @@ func opSep(op byte) byte {
 	}
 }
 
-func coerceString(val reflect.Value) (string, error) {
+func (e *Expander) coerceString(val reflect.Value) (string, error) {
 	if !val.IsValid() {
 		return "", errors.New("undefined value")
 	}
+	if e.Format != nil && val.CanInterface() {
+		if s, ok, err := e.Format(val.Interface()); ok || err != nil {
+			return s, err
+		}
+	}
 	typ := val.Type()
+	methods := typ.NumMethod() > 0
 	switch {
-	case typ.Implements(textMarshalerType):
+	case methods && typ.Implements(textMarshalerType):
 		data, err := val.Interface().(encoding.TextMarshaler).MarshalText()
 		return string(data), err
-	case typ.Kind() == reflect.String && !(typ.Implements(stringerType) || typ.Implements(errorType) || typ.Implements(formatterType)):
+	case typ.Kind() == reflect.String && !(methods && (typ.Implements(stringerType) || typ.Implements(errorType) || typ.Implements(formatterType))):
 		return val.String(), nil
 	default:
 		return fmt.Sprint(val), nil
 	}
 }
 
-func writeValue(sb *strings.Builder, op byte, s string) {
+func (e *Expander) writeValue(buf *buffer, op Operator, s string) {
 	if op == '+' || op == '#' {
 		for len(s) > 0 {
 			if pct, _, ok := cutPercentEscape(s); ok {
-				sb.WriteString(pct)
+				buf.WriteString(pct)
 				s = s[len(pct):]
 				continue
 			}
 			c, size := utf8.DecodeRuneInString(s)
 			if isUnreserved(c) || isReserved(c) {
-				sb.WriteString(s[:size])
+				buf.WriteString(s[:size])
 			} else {
-				percentEscape(sb, s[:size])
+				e.escapeRune(buf, op, c, s[:size])
 			}
 			s = s[size:]
 		}
@@ -285,21 +457,58 @@ func writeValue(sb *strings.Builder, op byte, s string) {
 		for len(s) > 0 {
 			c, size := utf8.DecodeRuneInString(s)
 			if isUnreserved(c) {
-				sb.WriteString(s[:size])
+				buf.WriteString(s[:size])
 			} else {
-				percentEscape(sb, s[:size])
+				e.escapeRune(buf, op, c, s[:size])
 			}
 			s = s[size:]
 		}
 	}
 }
 
-func modify(s string, modifier string) string {
-	if !strings.HasPrefix(modifier, ":") {
-		return s
+// escapeRune writes the rune c, encoded as s,
+// which is not allowed unencoded in an expansion with the operator op by RFC 6570.
+func (e *Expander) escapeRune(buf *buffer, op Operator, c rune, s string) {
+	query := op == '?' || op == '&'
+	switch {
+	case c == ' ' && e.FormSpaces && query:
+		buf.WriteByte('+')
+	case e.IRI && (isUCSChar(c) || query && isIPrivate(c)):
+		buf.WriteString(s)
+	case e.LowerHex:
+		for _, b := range []byte(s) {
+			buf.WriteByte('%')
+			buf.WriteByte(lowerHex(b >> 4))
+			buf.WriteByte(lowerHex(b & 0x0f))
+		}
+	default:
+		percentEscape(buf, s)
+	}
+}
+
+// isUCSChar reports whether c matches the ucschar production in RFC 3987.
+func isUCSChar(c rune) bool {
+	switch {
+	case 0xa0 <= c && c <= 0xd7ff, 0xf900 <= c && c <= 0xfdcf, 0xfdf0 <= c && c <= 0xffef:
+		return true
+	case 0x10000 <= c && c <= 0xeffff && c&0xffff <= 0xfffd:
+		return c >= 0xe1000 || c < 0xe0000
+	default:
+		return false
 	}
-	n, err := strconv.Atoi(modifier[1:])
-	if err != nil || n <= 0 {
+}
+
+// isIPrivate reports whether c matches the iprivate production in RFC 3987.
+func isIPrivate(c rune) bool {
+	return 0xe000 <= c && c <= 0xf8ff ||
+		0xf0000 <= c && c <= 0xffffd ||
+		0x100000 <= c && c <= 0x10fffd
+}
+
+// truncate returns the first n characters of s.
+// If n is zero, then truncate returns s unmodified.
+func truncate(s string, n int) string {
+	if n <= 0 {
 		return s
 	}
 	pos := 0
@@ -310,38 +519,6 @@ func modify(s string, modifier string) string {
 	return s[:pos]
 }
 
-// isEmpty reports whether v is undefined, an empty string,
-// or an array/slice/map with no defined elements.
-func isEmpty(v reflect.Value) bool {
-	switch v.Kind() {
-	case reflect.Invalid:
-		return true
-	case reflect.String:
-		return v.Len() == 0
-	case reflect.Map:
-		found := false
-		iterateMap(v, func(k string, elem reflect.Value) bool {
-			elem, _ = followIndirection(elem)
-			if elem.IsValid() {
-				found = true
-				return false
-			}
-			return true
-		})
-		return !found
-	case reflect.Slice, reflect.Array:
-		for i, n := 0, v.Len(); i < n; i++ {
-			elem, _ := followIndirection(v.Index(i))
-			if elem.IsValid() {
-				return false
-			}
-		}
-		return true
-	default:
-		return false
-	}
-}
-
 type varKind int
 
 const (
@@ -352,12 +529,30 @@ const (
 
 func kindOf(v reflect.Value) (varKind, reflect.Value) {
 	v, scalar := followIndirection(v)
-	switch {
-	case !v.IsValid():
+	if !v.IsValid() {
 		return 0, reflect.Value{}
-	case !scalar && ((v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String) || v.Kind() == reflect.Struct):
+	}
+	if scalar {
+		return scalarKind, v
+	}
+	typ := v.Type()
+	methods := typ.NumMethod() > 0
+	switch {
+	case methods && typ.Implements(mapValuerType):
+		return mapKind, v
+	case methods && typ.Implements(listValuerType):
+		return listKind, v
+	case v.Kind() == reflect.Func && (isSeq(typ) || isSeq2(typ)):
+		if v.IsNil() {
+			return 0, reflect.Value{}
+		}
+		if isSeq2(typ) {
+			return mapKind, v
+		}
+		return listKind, v
+	case (v.Kind() == reflect.Map && typ.Key().Kind() == reflect.String) || v.Kind() == reflect.Struct || isPairs(typ):
 		return mapKind, v
-	case !scalar && (v.Kind() == reflect.Slice || v.Kind() == reflect.Array):
+	case v.Kind() == reflect.Slice || v.Kind() == reflect.Array:
 		return listKind, v
 	default:
 		return scalarKind, v
@@ -372,8 +567,14 @@ func followIndirection(v reflect.Value) (_ reflect.Value, scalar bool) {
 
 		typ := v.Type()
 		k := typ.Kind()
+		methods := typ.NumMethod() > 0
 		switch {
-		case typ.Implements(stringerType) || typ.Implements(errorType) || typ.Implements(textMarshalerType) || typ.Implements(formatterType):
+		case methods && (typ.Implements(listValuerType) || typ.Implements(mapValuerType)):
+			if isNilable(k) && v.IsNil() {
+				return reflect.Value{}, false
+			}
+			return v, false
+		case methods && (typ.Implements(stringerType) || typ.Implements(errorType) || typ.Implements(textMarshalerType) || typ.Implements(formatterType)):
 			return v, true
 		case k != reflect.Pointer && k != reflect.Interface:
 			return v, false
@@ -385,7 +586,22 @@ func followIndirection(v reflect.Value) (_ reflect.Value, scalar bool) {
 	}
 }
 
-func iterateMap(m reflect.Value, f func(k string, v reflect.Value) bool) {
+// iterateMap writes each element of the associative array m.
+// Maps are iterated in sorted key order,
+// structs are iterated in field order,
+// and pairs are iterated in slice order.
+func (w *elementWriter) iterateMap(m reflect.Value) error {
+	if isSeq2(m.Type()) {
+		return w.iterateSeq2(m)
+	}
+	if implements(m.Type(), mapValuerType) {
+		hw := w.toHeap()
+		err := m.Interface().(MapValuer).MapValue(func(k, v string) bool {
+			return hw.writeMapValue(k, reflect.ValueOf(v))
+		})
+		*w = *hw
+		return err
+	}
 	switch m.Kind() {
 	case reflect.Map:
 		keys := m.MapKeys()
@@ -395,64 +611,466 @@ func iterateMap(m reflect.Value, f func(k string, v reflect.Value) bool) {
 		})
 
 		for _, k := range keys {
-			if !f(k.String(), m.MapIndex(k)) {
+			if !w.writeMapValue(k.String(), m.MapIndex(k)) {
 				break
 			}
 		}
 	case reflect.Struct:
-		sd := describeStruct(m.Type())
-		for i, name := range sd.fieldNames {
-			if name == "" {
+		sd := describeStruct(m.Type(), w.e.naming())
+		for i := range sd.fields {
+			field := &sd.fields[i]
+			v := field.value(m)
+			if !v.IsValid() {
 				continue
 			}
-			if !f(name, m.Field(i)) {
+			if !w.writeMapValue(field.name, v) {
+				break
+			}
+		}
+	case reflect.Slice:
+		// For mapKind, slices are guaranteed to have an element type of Pair.
+		for i, n := 0, m.Len(); i < n; i++ {
+			p := m.Index(i)
+			if !w.writeMapValue(p.Field(0).String(), p.Field(1)) {
 				break
 			}
 		}
 	default:
 		panic("unreachable")
 	}
+	return nil
+}
+
+// writeMapValue writes the element of an associative array
+// with the key k and the value v if v is defined.
+// A value that is a list is flattened into one element per defined list element,
+// so that a multi-value map like [net/url.Values] expands to repeated keys.
+// It reports whether iteration should continue.
+func (w *elementWriter) writeMapValue(k string, v reflect.Value) bool {
+	vk, v := kindOf(v)
+	switch vk {
+	case 0:
+		return true
+	case listKind:
+		if err := w.iterateList(k, v); err != nil && w.err == nil {
+			w.err = err
+		}
+		return w.err == nil
+	default:
+		return w.write(k, v)
+	}
 }
 
-var descriptors sync.Map
+// iterateList writes each defined element of the value list l
+// with the key k.
+func (w *elementWriter) iterateList(k string, l reflect.Value) error {
+	if isSeq(l.Type()) {
+		return w.iterateSeq(k, l)
+	}
+	if implements(l.Type(), listValuerType) {
+		hw := w.toHeap()
+		err := l.Interface().(ListValuer).ListValue(func(elem string) bool {
+			return hw.write(k, reflect.ValueOf(elem))
+		})
+		*w = *hw
+		return err
+	}
+	for i, n := 0, l.Len(); i < n; i++ {
+		elem, _ := followIndirection(l.Index(i))
+		if !elem.IsValid() {
+			continue
+		}
+		if !w.write(k, elem) {
+			break
+		}
+	}
+	return nil
+}
+
+// iterateComposite writes each defined element of the value list
+// or associative array v, depending on w.vk.
+func (w *elementWriter) iterateComposite(v reflect.Value) error {
+	if w.vk == mapKind {
+		return w.iterateMap(v)
+	}
+	return w.iterateList("", v)
+}
+
+// isSeq reports whether t is a function type
+// with the same shape as iter.Seq, like func(yield func(int) bool).
+func isSeq(t reflect.Type) bool {
+	yield, ok := yieldType(t)
+	return ok && yield.NumIn() == 1
+}
+
+// isSeq2 reports whether t is a function type
+// with the same shape as iter.Seq2 with a string key,
+// like func(yield func(string, int) bool).
+func isSeq2(t reflect.Type) bool {
+	yield, ok := yieldType(t)
+	return ok && yield.NumIn() == 2 && yield.In(0).Kind() == reflect.String
+}
+
+// yieldType returns the type of the yield argument to the iterator function type t.
+func yieldType(t reflect.Type) (reflect.Type, bool) {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return nil, false
+	}
+	yield := t.In(0)
+	if yield.Kind() != reflect.Func || yield.NumOut() != 1 || yield.Out(0) != boolType || yield.IsVariadic() {
+		return nil, false
+	}
+	return yield, true
+}
+
+// isPairs reports whether t is a slice of [Pair], like [Pairs].
+func isPairs(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem() == pairType
+}
+
+// isMultiValueMap reports whether t is a map of strings to string slices,
+// like [net/url.Values] or [net/http.Header].
+func isMultiValueMap(t reflect.Type) bool {
+	return t.Kind() == reflect.Map &&
+		t.Key().Kind() == reflect.String &&
+		t.Elem().Kind() == reflect.Slice &&
+		t.Elem().Elem().Kind() == reflect.String
+}
+
+// asAnyMap returns the map[string]any held by v, if any.
+func asAnyMap(v reflect.Value) (map[string]any, bool) {
+	if v.Type() != anyMapType || !v.CanInterface() {
+		return nil, false
+	}
+	return v.Interface().(map[string]any), true
+}
+
+// descriptors caches the structDescriptor of each struct type,
+// with one cache for each naming so that lookups hash only the type.
+var descriptors [ExactNames + 1][2]sync.Map
 
 type structDescriptor struct {
-	fieldNames  []string
+	fields      []structField
 	indexLookup map[string]int
 }
 
-func describeStruct(t reflect.Type) structDescriptor {
-	if sd, ok := descriptors.Load(t); ok {
+type structField struct {
+	name   string
+	index  []int
+	tagged bool
+	fieldOptions
+}
+
+// fieldOptions are the options in a "uritemplate" struct tag
+// that affect expansion.
+type fieldOptions struct {
+	omitEmpty bool
+	explode   bool
+	noExplode bool
+	asString  bool
+}
+
+// value returns the field of the struct v described by f
+// after applying f's options.
+// It returns the zero Value if the field is undefined.
+func (f *structField) value(v reflect.Value) reflect.Value {
+	v = f.field(v)
+	if !v.IsValid() {
+		return reflect.Value{}
+	}
+	if f.omitEmpty && isEmptyValue(v) {
+		return reflect.Value{}
+	}
+	if f.asString {
+		v, scalar := followIndirection(v)
+		if !v.IsValid() || scalar {
+			return v
+		}
+		switch v.Kind() {
+		case reflect.Array, reflect.Map, reflect.Slice, reflect.Struct:
+			return reflect.ValueOf(fmt.Sprint(v))
+		}
+		return v
+	}
+	return v
+}
+
+// isEmptyValue reports whether v is empty
+// in the sense of encoding/json's omitempty option.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	default:
+		return false
+	}
+}
+
+// field returns the field of the struct v described by f.
+// It returns the zero Value if f is promoted through a nil embedded pointer.
+func (f *structField) field(v reflect.Value) reflect.Value {
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// settableField returns the field of the settable struct v described by f,
+// allocating any nil embedded pointers along the way.
+func (f *structField) settableField(v reflect.Value) reflect.Value {
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// naming is the set of [Expander] options that determine struct field names.
+type naming struct {
+	style    FieldNaming
+	jsonTags bool
+}
+
+func (e *Expander) naming() naming {
+	return naming{
+		style:    e.FieldNaming,
+		jsonTags: e.JSONTags,
+	}
+}
+
+// cache returns the descriptor cache for nm.
+// Unknown styles name fields like LowerCamelCase, so they share its cache.
+func (nm naming) cache() *sync.Map {
+	style := nm.style
+	if style < LowerCamelCase || style > ExactNames {
+		style = LowerCamelCase
+	}
+	tags := 0
+	if nm.jsonTags {
+		tags = 1
+	}
+	return &descriptors[style][tags]
+}
+
+func describeStruct(t reflect.Type, nm naming) structDescriptor {
+	cache := nm.cache()
+	if sd, ok := cache.Load(t); ok {
 		return sd.(structDescriptor)
 	}
 	sd := structDescriptor{
-		fieldNames:  make([]string, t.NumField()),
-		indexLookup: make(map[string]int),
+		fields: structFields(t, nm),
 	}
-	for i := range sd.fieldNames {
-		field := t.Field(i)
-		if !field.IsExported() {
-			continue
+	sd.indexLookup = make(map[string]int, len(sd.fields))
+	for i, f := range sd.fields {
+		sd.indexLookup[f.name] = i
+	}
+	cache.Store(t, sd)
+	return sd
+}
+
+// structFields returns the named fields of the struct type t in field order.
+// Fields of embedded structs tagged with the "inline" option are promoted
+// using the same rules as encoding/json:
+// a shallower field hides a deeper one,
+// and among fields with the same name at the same depth,
+// a sole tagged field hides the rest.
+// Otherwise, conflicting fields are all ignored.
+func structFields(t reflect.Type, nm naming) []structField {
+	type embedded struct {
+		typ   reflect.Type
+		index []int
+	}
+	var fields []structField
+	visited := make(map[reflect.Type]bool)
+	for next := []embedded{{typ: t}}; len(next) > 0; {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.typ] {
+				continue
+			}
+			for i := 0; i < e.typ.NumField(); i++ {
+				field := e.typ.Field(i)
+				tag, hasTag := field.Tag.Lookup("uritemplate")
+				if !hasTag && nm.jsonTags {
+					// Options in a json tag have different meanings,
+					// so only use the name.
+					tag, _, _ = strings.Cut(field.Tag.Get("json"), ",")
+				}
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+				if field.Anonymous && opts.contains("inline") {
+					ft := field.Type
+					if ft.Kind() == reflect.Pointer && field.IsExported() {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{typ: ft, index: index})
+						continue
+					}
+				}
+				if !field.IsExported() {
+					continue
+				}
+				tagged := name != ""
+				if !tagged {
+					name = nm.style.fieldName(field.Name)
+				}
+				fields = append(fields, structField{
+					name:   name,
+					index:  index,
+					tagged: tagged,
+					fieldOptions: fieldOptions{
+						omitEmpty: opts.contains("omitempty"),
+						explode:   opts.contains("explode"),
+						noExplode: opts.contains("noexplode"),
+						asString:  opts.contains("string"),
+					},
+				})
+			}
+		}
+		// Mark types after the whole depth has been processed
+		// so that the same type embedded twice at one depth conflicts with itself.
+		for _, e := range current {
+			visited[e.typ] = true
+		}
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool {
+		fi, fj := &fields[i], &fields[j]
+		if fi.name != fj.name {
+			return fi.name < fj.name
+		}
+		if len(fi.index) != len(fj.index) {
+			return len(fi.index) < len(fj.index)
 		}
-		var fieldName string
-		if tag := field.Tag.Get("uritemplate"); tag == "-" {
+		return fi.tagged && !fj.tagged
+	})
+	dominant := fields[:0]
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+		if j == i+1 || len(fields[i+1].index) > len(fields[i].index) || fields[i].tagged != fields[i+1].tagged {
+			dominant = append(dominant, fields[i])
+		}
+		i = j
+	}
+	fields = dominant
+	sort.Slice(fields, func(i, j int) bool {
+		return lessIndex(fields[i].index, fields[j].index)
+	})
+	return fields
+}
+
+func lessIndex(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldName returns the variable name for a struct field
+// without a name in its tag.
+func (style FieldNaming) fieldName(name string) string {
+	switch style {
+	case SnakeCase:
+		return joinWords(name, '_')
+	case KebabCase:
+		return joinWords(name, '-')
+	case ExactNames:
+		return name
+	default:
+		_, firstRuneSize := utf8.DecodeRuneInString(name)
+		return strings.ToLower(name[:firstRuneSize]) + name[firstRuneSize:]
+	}
+}
+
+// joinWords splits the Go identifier s into words
+// at underscores and changes in case,
+// then joins the lowercased words with sep.
+// An initialism is treated as a single word,
+// so "UserID" becomes "user_id" and "HTTPServer" becomes "http_server".
+func joinWords(s string, sep rune) string {
+	sb := new(strings.Builder)
+	sb.Grow(len(s) + 4)
+	runes := []rune(s)
+	for i, c := range runes {
+		if c == '_' {
+			if sb.Len() > 0 {
+				sb.WriteRune(sep)
+			}
 			continue
-		} else if tag != "" {
-			fieldName = tag
-		} else {
-			_, firstRuneSize := utf8.DecodeRuneInString(field.Name)
-			fieldName = strings.ToLower(field.Name[:firstRuneSize]) + field.Name[firstRuneSize:]
 		}
-		sd.fieldNames[i] = fieldName
-		sd.indexLookup[fieldName] = i
+		if i > 0 && unicode.IsUpper(c) {
+			prev := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+				sb.WriteRune(sep)
+			}
+		}
+		sb.WriteRune(unicode.ToLower(c))
 	}
-	descriptors.Store(t, sd)
-	return sd
+	return sb.String()
+}
+
+// parseTag splits a "uritemplate" struct tag into its name and options.
+func parseTag(tag string) (name string, opts tagOptions) {
+	name, rest, _ := strings.Cut(tag, ",")
+	return name, tagOptions(rest)
+}
+
+// tagOptions is the comma-separated list of options
+// that follows the name in a "uritemplate" struct tag.
+type tagOptions string
+
+func (opts tagOptions) contains(name string) bool {
+	for s := string(opts); s != ""; {
+		var opt string
+		opt, s, _ = strings.Cut(s, ",")
+		if opt == name {
+			return true
+		}
+	}
+	return false
 }
 
 var (
+	anyMapType        = reflect.TypeOf(map[string]any(nil))
+	boolType          = reflect.TypeOf(false)
+	contextType       = reflect.TypeOf((*context.Context)(nil)).Elem()
 	errorType         = reflect.TypeOf((*error)(nil)).Elem()
 	formatterType     = reflect.TypeOf((*fmt.Formatter)(nil)).Elem()
+	layersType        = reflect.TypeOf(Layers(nil))
+	listValuerType    = reflect.TypeOf((*ListValuer)(nil)).Elem()
+	mapValuerType     = reflect.TypeOf((*MapValuer)(nil)).Elem()
+	pairType          = reflect.TypeOf(Pair{})
+	sourceType        = reflect.TypeOf((*Source)(nil)).Elem()
 	stringType        = reflect.TypeOf((*string)(nil)).Elem()
 	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
 	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
@@ -0,0 +1,47 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !go1.23
+
+package uritemplate
+
+import "reflect"
+
+// iterateSeq writes each defined element of the iterator function seq
+// with the key k.
+func (w *elementWriter) iterateSeq(k string, seq reflect.Value) error {
+	hw := w.toHeap()
+	yield := reflect.MakeFunc(seq.Type().In(0), func(args []reflect.Value) []reflect.Value {
+		elem, _ := followIndirection(args[0])
+		more := !elem.IsValid() || hw.write(k, elem)
+		return []reflect.Value{reflect.ValueOf(more)}
+	})
+	seq.Call([]reflect.Value{yield})
+	*w = *hw
+	return nil
+}
+
+// iterateSeq2 writes each (key, value) pair of the iterator function seq.
+func (w *elementWriter) iterateSeq2(seq reflect.Value) error {
+	hw := w.toHeap()
+	yield := reflect.MakeFunc(seq.Type().In(0), func(args []reflect.Value) []reflect.Value {
+		more := hw.writeMapValue(args[0].String(), args[1])
+		return []reflect.Value{reflect.ValueOf(more)}
+	})
+	seq.Call([]reflect.Value{yield})
+	*w = *hw
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Unmarshal matches uri against the template
+// and stores the variable values in the value pointed to by v.
+// See [Template.Match] for how URIs are matched
+// and [Unmarshal] for how values are stored.
+// Struct fields are named using the options of the [Expander] that parsed t.
+func (t *Template) Unmarshal(uri string, v any) error {
+	values, err := t.Match(uri)
+	if err != nil {
+		return err
+	}
+	if err := unmarshal(values, v, t.opts.naming()); err != nil {
+		return fmt.Errorf("match %q against %q: %w", uri, t.s, err)
+	}
+	return nil
+}
+
+// Unmarshal stores matched variable values in the value pointed to by v,
+// which must be a pointer to a struct or a map with string keys.
+// Struct fields are named the same way as in [Expand].
+// Variables that do not correspond to a field are ignored
+// and fields without a corresponding variable are left unchanged.
+//
+// Values are converted to the field's or map element's type as follows:
+//
+//  1. If a pointer to the type implements [encoding.TextUnmarshaler],
+//     then its UnmarshalText method is called with [Value.String].
+//  2. Strings, booleans, integers, and floating-point numbers
+//     are parsed from [Value.String] using [strconv].
+//  3. Slices and arrays are filled from [Value.List],
+//     converting each element as above.
+//  4. Maps with string keys and structs are filled from [Value.Map],
+//     converting each element as above.
+//  5. An empty interface is set to a string, a []string,
+//     or a map[string]string depending on how the value was matched.
+//  6. Pointers are allocated as needed.
+func Unmarshal(values map[string]Value, v any) error {
+	return unmarshal(values, v, naming{})
+}
+
+func unmarshal(values map[string]Value, v any, nm naming) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("unmarshal uri template values: want non-nil pointer (got %T)", v)
+	}
+	rv = rv.Elem()
+
+	names := sortedKeys(values)
+
+	switch rv.Kind() {
+	case reflect.Struct:
+		sd := describeStruct(rv.Type(), nm)
+		for _, name := range names {
+			i, ok := sd.indexLookup[name]
+			if !ok {
+				continue
+			}
+			if err := unmarshalValue(sd.fields[i].settableField(rv), values[name], nm); err != nil {
+				return fmt.Errorf("unmarshal uri template values: %s: %w", name, err)
+			}
+		}
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unmarshal uri template values: unsupported type %v", rv.Type())
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMapWithSize(rv.Type(), len(values)))
+		}
+		for _, name := range names {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := unmarshalValue(elem, values[name], nm); err != nil {
+				return fmt.Errorf("unmarshal uri template values: %s: %w", name, err)
+			}
+			rv.SetMapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()), elem)
+		}
+	default:
+		return fmt.Errorf("unmarshal uri template values: unsupported type %v", rv.Type())
+	}
+	return nil
+}
+
+// unmarshalValue stores val into the settable value dst.
+func unmarshalValue(dst reflect.Value, val Value, nm naming) error {
+	for dst.Kind() == reflect.Pointer {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		dst = dst.Elem()
+	}
+	if dst.CanAddr() {
+		if u, ok := dst.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return u.UnmarshalText([]byte(val.String()))
+		}
+	}
+
+	switch dst.Kind() {
+	case reflect.String:
+		dst.SetString(val.String())
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val.String())
+		if err != nil {
+			return err
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(val.String(), 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := strconv.ParseUint(val.String(), 10, dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(val.String(), dst.Type().Bits())
+		if err != nil {
+			return err
+		}
+		dst.SetFloat(f)
+	case reflect.Slice:
+		list := val.List()
+		s := reflect.MakeSlice(dst.Type(), len(list), len(list))
+		for i, elem := range list {
+			if err := unmarshalString(s.Index(i), elem, nm); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+	case reflect.Array:
+		list := val.List()
+		if len(list) > dst.Len() {
+			return fmt.Errorf("%d elements do not fit in %v", len(list), dst.Type())
+		}
+		for i := 0; i < dst.Len(); i++ {
+			if i >= len(list) {
+				dst.Index(i).Set(reflect.Zero(dst.Type().Elem()))
+				continue
+			}
+			if err := unmarshalString(dst.Index(i), list[i], nm); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if dst.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("unsupported type %v", dst.Type())
+		}
+		m := val.Map()
+		newMap := reflect.MakeMapWithSize(dst.Type(), len(m))
+		for _, k := range sortedKeys(m) {
+			elem := m[k]
+			elemValue := reflect.New(dst.Type().Elem()).Elem()
+			if err := unmarshalString(elemValue, elem, nm); err != nil {
+				return fmt.Errorf("key %q: %w", k, err)
+			}
+			newMap.SetMapIndex(reflect.ValueOf(k).Convert(dst.Type().Key()), elemValue)
+		}
+		dst.Set(newMap)
+	case reflect.Struct:
+		sd := describeStruct(dst.Type(), nm)
+		m := val.Map()
+		for _, k := range sortedKeys(m) {
+			i, ok := sd.indexLookup[k]
+			if !ok {
+				continue
+			}
+			if err := unmarshalString(sd.fields[i].settableField(dst), m[k], nm); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+		}
+	case reflect.Interface:
+		if dst.NumMethod() != 0 {
+			return fmt.Errorf("unsupported type %v", dst.Type())
+		}
+		switch {
+		case val.keys != nil:
+			dst.Set(reflect.ValueOf(val.Map()))
+		case len(val.items) > 1:
+			dst.Set(reflect.ValueOf(val.List()))
+		default:
+			dst.Set(reflect.ValueOf(val.String()))
+		}
+	default:
+		return fmt.Errorf("unsupported type %v", dst.Type())
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order
+// so that errors are reported deterministically.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unmarshalString(dst reflect.Value, s string, nm naming) error {
+	return unmarshalValue(dst, Value{items: []string{s}}, nm)
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 Ross Light
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//		 https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package uritemplate
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	type params struct {
+		ID      int64 `uritemplate:"id"`
+		Verbose bool
+		Ratio   float64
+		Name    *string
+		Tags    []string `uritemplate:"tag"`
+		Counts  [2]uint8
+		Filter  map[string]int
+		Addr    netip.Addr
+		Ignored string `uritemplate:"-"`
+	}
+	name := "Hello World!"
+	tests := []struct {
+		template string
+		uri      string
+		want     params
+	}{
+		{
+			template: "/items/{id}{?verbose,ratio}",
+			uri:      "/items/42?verbose=true&ratio=0.5",
+			want:     params{ID: 42, Verbose: true, Ratio: 0.5},
+		},
+		{
+			template: "/hello/{name}",
+			uri:      "/hello/Hello%20World%21",
+			want:     params{Name: &name},
+		},
+		{
+			template: "/search{?tag*,counts}",
+			uri:      "/search?tag=a&tag=b&counts=1,2",
+			want:     params{Tags: []string{"a", "b"}, Counts: [2]uint8{1, 2}},
+		},
+		{
+			template: "/search{?filter*}",
+			uri:      "/search?x=1&y=2",
+			want:     params{Filter: map[string]int{"x": 1, "y": 2}},
+		},
+		{
+			template: "/ping/{addr}{?ignored}",
+			uri:      "/ping/127.0.0.1?ignored=x",
+			want:     params{Addr: netip.MustParseAddr("127.0.0.1")},
+		},
+	}
+	for _, test := range tests {
+		var got params
+		if err := MustParse(test.template).Unmarshal(test.uri, &got); err != nil {
+			t.Errorf("Parse(%q).Unmarshal(%q, &got): %v", test.template, test.uri, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Parse(%q).Unmarshal(%q, &got); got = %+v; want %+v", test.template, test.uri, got, test.want)
+		}
+	}
+}
+
+func TestUnmarshalInline(t *testing.T) {
+	type request struct {
+		Q           string
+		*Pagination `uritemplate:",inline"`
+	}
+	var got request
+	if err := MustParse("/items{?q,page,limit}").Unmarshal("/items?q=go&page=2", &got); err != nil {
+		t.Fatal(err)
+	}
+	want := request{Q: "go", Pagination: &Pagination{Page: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %+v; want %+v", got, want)
+	}
+}
+
+func TestTemplateUnmarshalFieldNaming(t *testing.T) {
+	type params struct {
+		PageSize int
+		Sort     string `json:"order"`
+	}
+	e := &Expander{FieldNaming: SnakeCase, JSONTags: true}
+	tmpl, err := e.Parse("/items{?page_size,order}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got params
+	if err := tmpl.Unmarshal("/items?page_size=20&order=asc", &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (params{PageSize: 20, Sort: "asc"}); got != want {
+		t.Errorf("got = %+v; want %+v", got, want)
+	}
+}
+
+func TestUnmarshalMap(t *testing.T) {
+	var got map[string]any
+	err := MustParse("/{a}{/b*}{?c*}").Unmarshal("/x/y/z?k=v", &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"a": "x",
+		"b": []string{"y", "z"},
+		"c": map[string]string{"k": "v"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got = %#v; want %#v", got, want)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var dst struct{ Id int }
+	if err := MustParse("/{id}").Unmarshal("/abc", &dst); err == nil {
+		t.Error("Unmarshal of non-integer into int did not return an error")
+	}
+	if err := MustParse("/{id}").Unmarshal("/1", dst); err == nil {
+		t.Error("Unmarshal into non-pointer did not return an error")
+	}
+	if err := MustParse("/{id}").Unmarshal("/1", nil); err == nil {
+		t.Error("Unmarshal into nil did not return an error")
+	}
+
+	// The first invalid key in sorted order is reported.
+	var nested struct {
+		P struct{ A, B, C int }
+	}
+	tmpl := MustParse("{?p*}")
+	for i := 0; i < 10; i++ {
+		err := tmpl.Unmarshal("?c=x&b=y&a=1", &nested)
+		if err == nil || !strings.Contains(err.Error(), "p: b:") {
+			t.Fatalf("Unmarshal(...) error = %v; want error for p: b", err)
+		}
+	}
+}
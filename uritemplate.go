@@ -14,151 +14,918 @@
 //
 // SPDX-License-Identifier: Apache-2.0
 
-// Package uritemplate provides a function to expand variables
-// in URI Templates as specified by RFC 6570.
+// Package uritemplate provides functions to parse and expand
+// URI Templates as specified by RFC 6570.
 // This package provides a Level 4 template processor.
 package uritemplate
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 )
 
 // Expand expands variables in the given URI template.
-// The data argument is a map with string keys,
-// a struct, or a pointer to either of these.
+// The data argument is a [Source], a map with string keys,
+// a struct, a [Pairs], a [Layers], or a pointer to any of these.
 // Variable values are interpreted as follows:
 //
-//  1. If the value implements [encoding.TextMarshaler],
+//  1. If the value implements [ListValuer] or [MapValuer],
+//     then the value will be treated as a value list or an associative array,
+//     respectively.
+//  2. If the value implements [encoding.TextMarshaler],
 //     then the value's MarshalText method will be called
 //     and the result is used as a string.
-//  2. If the value implements [fmt.Stringer] or [fmt.Formatter],
+//  3. If the value implements [fmt.Stringer] or [fmt.Formatter],
 //     then [fmt.Sprint] will be called on the value
 //     and the result is used as a string.
-//  3. If the value is a slice or an array,
+//  4. If the value is a slice or an array other than [Pairs],
+//     or an iterator function like [iter.Seq],
 //     then the value will be treated as a value list.
-//  4. If the value is a map or a struct,
+//  5. If the value is a map, a struct, a [Pairs],
+//     or an iterator function with string keys like [iter.Seq2][string, V],
 //     then the value will be treated as an associative array.
-//  5. Otherwise, [fmt.Sprint] will be called on the value
+//     An element of an associative array that is a value list
+//     is expanded as one (name, value) pair per list element.
+//     Iterator functions are called once each time the variable is expanded.
+//  6. Otherwise, [fmt.Sprint] will be called on the value
 //     and the result is used as a string.
 //
+// As RFC 6570 Section 2.3 specifies, a value list or associative array
+// with no defined elements is undefined,
+// whether or not the variable has the explode modifier.
+// For example, {?list} and {?list*} both expand to the empty string
+// if list is an empty slice.
+//
 // # Structs
 //
 // Go structs are used as ordered associative arrays
 // where each exported field is a (name, value) pair.
 // Without a tag, a field's pair name will be the same as the field's name
 // with the first letter lowercased.
+// [Expander.FieldNaming] and [Expander.JSONTags] change this default.
 // The pair name can be overridden with a "uritemplate" field tag
 // or the field can be ignored entirely with `uritemplate:"-"`.
-// An embedded field is treated the same as other fields.
+// An embedded field is treated the same as other fields
+// unless it is a struct (or a pointer to a struct)
+// tagged with the "inline" option, like `uritemplate:",inline"`.
+// The fields of an inline struct are promoted into the outer struct
+// following the same visibility rules as [encoding/json]:
+// a field hides fields with the same name at greater depth,
+// a tagged field hides untagged fields with the same name at the same depth,
+// and any other fields with the same name are ignored.
+// Fields promoted through a nil pointer are undefined.
+//
+// The tag may also list options after the name, separated by commas,
+// like `uritemplate:"page,omitempty"`. The options are:
+//
+//   - omitempty: the field is undefined if it is false, 0, a nil pointer,
+//     a nil interface value, or an empty array, slice, map, or string.
+//   - explode: the variable is expanded as if it had the explode modifier.
+//   - noexplode: the variable is expanded as if it did not have the explode modifier.
+//   - string: a slice, array, map, or struct is formatted with [fmt.Sprint]
+//     and treated as a string instead of a composite value.
+//   - inline: see above.
+//
+// The explode and noexplode options only apply when the field is looked up
+// directly as a variable, not when its struct is used as an associative array.
+//
+// # Multi-value maps
+//
+// Maps of strings to string slices, like [net/url.Values] and [net/http.Header],
+// may have several values for each key.
+// If such a map is the data argument and a variable has exactly one value,
+// then the variable is treated as a string rather than a value list.
+// When such a map is used as an associative array,
+// keys with several values are repeated for each value,
+// so {?params*} expands to "?key=a&key=b" rather than "?key=a,b".
+//
+// # Lazy values
+//
+// A variable value that is a func() (T, error)
+// or a func(context.Context) (T, error)
+// is called when the template references the variable,
+// and its result is interpreted as above.
+// The context passed is the one given to [ExpandContext]
+// or [context.Background] for the other expansion functions.
+// Each lazy variable is called at most once per expansion,
+// even if the template references it several times.
+// With [Expander.NestedNames], lazy values are also resolved
+// while navigating to a nested variable.
+// If a lazy value returns an error, then expansion returns an error that wraps it.
+// Functions in lists or associative arrays are not called.
+//
+// # Errors
+//
+// If the template is malformed, then Expand returns a [*SyntaxError]
+// for the first syntax error.
+// Use [Parse] to obtain every syntax error in a template.
+// If a variable's value cannot be converted to a string,
+// then Expand returns an error that wraps a [*ValueError].
+// In either case, Expand continues past the error
+// and returns its best effort at expanding the rest of the template.
 func Expand(template string, data any) (string, error) {
-	sb := new(strings.Builder)
-	sb.Grow(len(template))
-	dataValue := reflect.ValueOf(data)
+	return new(Expander).Expand(template, data)
+}
+
+// ExpandContext is like [Expand]
+// but passes ctx to lazy values that accept a [context.Context].
+func ExpandContext(ctx context.Context, template string, data any) (string, error) {
+	return new(Expander).ExpandContext(ctx, template, data)
+}
+
+// AppendExpand is like [Expand] but appends the expanded URI to dst
+// and returns the extended buffer.
+func AppendExpand(dst []byte, template string, data any) ([]byte, error) {
+	return new(Expander).AppendExpand(dst, template, data)
+}
+
+// ExpandTo is like [Expand] but writes the expanded URI to w.
+// If expansion fails, then ExpandTo does not write anything to w.
+func ExpandTo(w io.Writer, template string, data any) error {
+	return new(Expander).ExpandTo(w, template, data)
+}
+
+// A Source provides variable values for expansion.
+// If the data passed to expansion implements Source,
+// then its Lookup method is used to find variables instead of reflection.
+type Source interface {
+	// Lookup returns the value of the variable with the given name
+	// and reports whether the variable is defined.
+	// A nil value is treated as undefined.
+	Lookup(name string) (value any, ok bool)
+}
+
+// SourceFunc is a function that implements [Source].
+type SourceFunc func(name string) (value any, ok bool)
+
+// Lookup returns f(name).
+func (f SourceFunc) Lookup(name string) (value any, ok bool) {
+	return f(name)
+}
+
+// A ListValuer is a value that expands as a value list.
+// ListValue calls yield for each element of the list in order,
+// stopping early if yield returns false.
+// An error returned by ListValue is returned from expansion.
+type ListValuer interface {
+	ListValue(yield func(elem string) bool) error
+}
+
+// A MapValuer is a value that expands as an associative array.
+// MapValue calls yield for each (name, value) pair of the array in order,
+// stopping early if yield returns false.
+// An error returned by MapValue is returned from expansion.
+type MapValuer interface {
+	MapValue(yield func(key, value string) bool) error
+}
+
+// A Pair is a (name, value) pair in an associative array.
+type Pair struct {
+	Key   string
+	Value any
+}
+
+// Pairs is an associative array that expands in slice order,
+// unlike maps, which expand in sorted key order.
+// Any slice of [Pair] is treated the same way.
+// As the data argument to expansion,
+// variables are looked up by the first pair with a matching key.
+type Pairs []Pair
+
+// Layers is a list of data in priority order.
+// Each element of Layers can be any data accepted by [Expand],
+// including another Layers.
+// A variable is looked up in each layer in turn,
+// and the first layer in which the variable is defined
+// (present and not nil) provides its value.
+// This is useful for request-specific values that override defaults.
+type Layers []any
+
+// Lookup returns the value of the variable with the given name
+// from the first layer that defines it.
+// Struct fields are named as in [Expand].
+func (l Layers) Lookup(name string) (value any, ok bool) {
+	v, _ := lookupLayers(l, name, naming{})
+	if !v.IsValid() || !v.CanInterface() {
+		return nil, false
+	}
+	return v.Interface(), true
+}
+
+// An Expander expands URI templates with optional behavior
+// beyond what RFC 6570 specifies.
+// The zero value expands templates exactly like [Expand].
+type Expander struct {
+	// Strict causes expansion to fail for every variable
+	// that the template references but that is not defined by the data:
+	// variables that are missing, nil, or not exported from a struct.
+	// The error wraps a [*ValueError] that wraps [ErrUndefined].
+	// By default, undefined variables are skipped as RFC 6570 specifies.
+	Strict bool
+
+	// NestedNames causes variable names containing dots
+	// to navigate nested data.
+	// For example, {user.id} expands the "id" key or field
+	// of the "user" key or field of the data.
+	// A key or field that matches the full name (like "user.id")
+	// takes precedence over navigation.
+	NestedNames bool
+
+	// FieldNaming determines the names of struct fields
+	// that do not have a name in their tag.
+	// The default is [LowerCamelCase].
+	FieldNaming FieldNaming
+
+	// JSONTags causes struct fields without a "uritemplate" tag
+	// to use the name in their "json" tag, if any.
+	// A field with a `json:"-"` tag is ignored.
+	// Only the name is used from a json tag; options are ignored.
+	JSONTags bool
+
+	// LowerHex causes percent-encoded octets in expanded values
+	// to use lowercase hexadecimal digits (like "%2f")
+	// instead of the uppercase digits that RFC 3986 recommends.
+	// Literals in the template are not affected.
+	LowerHex bool
+
+	// FormSpaces causes spaces in form-style query expansions
+	// ({?var} and {&var}) to be encoded as "+"
+	// like in application/x-www-form-urlencoded data
+	// instead of "%20".
+	FormSpaces bool
+
+	// IRI causes expansion to produce an Internationalized Resource Identifier
+	// as described in RFC 6570 Section 1.6.
+	// Non-ASCII characters allowed in IRIs by RFC 3987
+	// are copied to the output instead of being percent-encoded.
+	IRI bool
+
+	// Format, if not nil, is called to convert each value to a string
+	// before the rules documented in [Expand] are applied.
+	// This includes strings, the elements of lists,
+	// and the values of associative arrays.
+	// If Format reports ok = false and returns a nil error,
+	// then the value is converted using the default rules.
+	Format func(v any) (s string, ok bool, err error)
+
+	// MaxLevel, if positive, causes [Expander.Parse] to reject
+	// expressions that require a higher RFC 6570 level than MaxLevel
+	// with an error code of [ErrLevelExceeded].
+	// See [Expression.Level] for how levels are determined.
+	// Expansion without parsing first is not affected.
+	MaxLevel int
+}
+
+// FieldNaming is a strategy for deriving variable names from struct field names.
+type FieldNaming int
+
+// Field naming strategies.
+const (
+	// LowerCamelCase lowercases the first letter of the field name,
+	// so PageSize becomes pageSize.
+	// Only the first letter is changed, so ID becomes iD.
+	LowerCamelCase FieldNaming = iota
+	// SnakeCase lowercases the words of the field name and joins them with underscores,
+	// so PageSize becomes page_size and UserID becomes user_id.
+	SnakeCase
+	// KebabCase lowercases the words of the field name and joins them with hyphens,
+	// so PageSize becomes page-size.
+	// Variable names cannot contain hyphens,
+	// so such fields are only useful in structs expanded as associative arrays.
+	KebabCase
+	// ExactNames uses the field name as-is.
+	ExactNames
+)
+
+// ErrUndefined is wrapped by the errors returned from expansion
+// in [Expander.Strict] mode when a variable is undefined.
+var ErrUndefined = errors.New("undefined variable")
+
+// Expand expands variables in the given URI template
+// using the Expander's options.
+// See [Expand] for how data is interpreted.
+func (e *Expander) Expand(template string, data any) (string, error) {
+	return e.ExpandContext(context.Background(), template, data)
+}
+
+// ExpandContext is like [Expander.Expand]
+// but passes ctx to lazy values that accept a [context.Context].
+func (e *Expander) ExpandContext(ctx context.Context, template string, data any) (string, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var err error
+	*buf, err = e.appendExpand(ctx, *buf, template, data)
+	return string(*buf), err
+}
+
+// ExpandTo is like [Expander.Expand] but writes the expanded URI to w.
+// If expansion fails, then ExpandTo does not write anything to w.
+func (e *Expander) ExpandTo(w io.Writer, template string, data any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var err error
+	*buf, err = e.AppendExpand(*buf, template, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(*buf)
+	return err
+}
+
+// AppendExpand is like [Expander.Expand] but appends the expanded URI to dst
+// and returns the extended buffer.
+func (e *Expander) AppendExpand(dst []byte, template string, data any) ([]byte, error) {
+	return e.appendExpand(context.Background(), dst, template, data)
+}
+
+func (e *Expander) appendExpand(ctx context.Context, dst []byte, template string, data any) ([]byte, error) {
+	buf := buffer(dst)
+	x := &expansion{ctx: ctx, data: reflect.ValueOf(data)}
 	var firstError error
-	for i := 0; i < len(template); {
-		c, size := utf8.DecodeRuneInString(template[i:])
+	vars := getVarSpecs()
+	p := parser{template: template, expr: Expression{Vars: *vars}}
+	for !p.done() {
+		tok := p.next()
 		switch {
-		case isLiteral(c):
-			if literalNeedsPercentEscape(c) {
-				percentEscape(sb, template[i:i+size])
-			} else {
-				sb.WriteString(template[i : i+size])
+		case tok.err != nil:
+			if firstError == nil {
+				firstError = tok.err
 			}
-			i += size
-		case c == '{':
-			exprLen, err := expandExpression(sb, template[i:], dataValue)
-			if err != nil && firstError == nil {
+			if template[tok.pos] == '{' {
+				buf.WriteString(template[tok.pos:tok.end])
+			}
+		case tok.isExpr:
+			if err := e.expandExpression(&buf, &p.expr, x); err != nil && firstError == nil {
 				firstError = fmt.Errorf("expand uri template %q: %w", template, err)
 			}
-			i += exprLen
-		case c == '%':
-			seq, _, ok := cutPercentEscape(template[i:])
-			if !ok && firstError == nil {
-				firstError = fmt.Errorf("expand uri template %q: invalid percent escape %q", template, seq)
+		default:
+			writeLiteral(&buf, template[tok.pos:tok.end])
+		}
+	}
+	*vars = p.expr.Vars
+	putVarSpecs(vars)
+	return buf, firstError
+}
+
+// Template is a parsed URI template.
+// A Template is safe to use from multiple goroutines.
+type Template struct {
+	s     string
+	parts []part
+	opts  Expander
+	// defaults is the data bound by [Template.With] or nil.
+	defaults any
+
+	matchOnce   sync.Once
+	matchRegexp *regexp.Regexp
+	// matchExprs is the expression matched by each group of matchRegexp.
+	matchExprs []*Expression
+	matchErr   error
+}
+
+// part is a single literal or expression in a [Template].
+type part struct {
+	pos, end int
+	// literal is the percent-encoded literal text.
+	// It is only meaningful if expr is nil.
+	literal string
+	expr    *Expression
+}
+
+// A Part is a literal or an expression in a template.
+type Part struct {
+	// Pos is the byte offset of the start of the part in the template.
+	Pos int
+	// End is the byte offset immediately after the part in the template.
+	End int
+	// Literal is the part's source text if Expr is nil.
+	// Literal may contain characters that are percent-encoded during expansion.
+	Literal string
+	// Expr is the part's parsed expression
+	// or nil if the part is a literal.
+	Expr *Expression
+}
+
+// An Expression is a parsed template expression,
+// like "{var}" or "{?x,y}".
+type Expression struct {
+	Operator Operator
+	Vars     []VarSpec
+}
+
+// String returns the expression in template syntax.
+func (expr *Expression) String() string {
+	sb := new(strings.Builder)
+	sb.WriteString("{")
+	sb.WriteString(expr.Operator.String())
+	for i, spec := range expr.Vars {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(spec.String())
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// Level returns the lowest RFC 6570 conformance level
+// that supports the expression:
+//
+//  1. Simple string expansion of a single variable, like "{var}".
+//  2. Reserved or fragment expansion of a single variable,
+//     like "{+var}" or "{#var}".
+//  3. Multiple variables or any of the other operators,
+//     like "{x,y}" or "{?x,y}".
+//  4. Prefix or explode modifiers, like "{var:3}" or "{/list*}".
+func (expr *Expression) Level() int {
+	for _, spec := range expr.Vars {
+		if spec.Explode || spec.MaxLength > 0 {
+			return 4
+		}
+	}
+	switch {
+	case len(expr.Vars) > 1:
+		return 3
+	case expr.Operator == OpSimple:
+		return 1
+	case expr.Operator == OpReserved || expr.Operator == OpFragment:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// A VarSpec is a variable reference in an expression,
+// along with its modifier.
+type VarSpec struct {
+	// Name is the variable's name as written in the template.
+	Name string
+	// Explode is true if the variable has an explode modifier ("*").
+	Explode bool
+	// MaxLength is the length of the variable's prefix modifier
+	// or zero if the variable does not have a prefix modifier.
+	MaxLength int
+
+	// Pos is the byte offset of the start of the variable name in the template.
+	Pos int
+	// End is the byte offset immediately after the variable's modifier
+	// in the template.
+	End int
+}
+
+// String returns the variable reference in template syntax.
+func (spec VarSpec) String() string {
+	switch {
+	case spec.Explode:
+		return spec.Name + "*"
+	case spec.MaxLength > 0:
+		return spec.Name + ":" + strconv.Itoa(spec.MaxLength)
+	default:
+		return spec.Name
+	}
+}
+
+// Operator is an expression's operator.
+type Operator byte
+
+// Expression operators defined in RFC 6570.
+const (
+	OpSimple            Operator = 0   // {var}
+	OpReserved          Operator = '+' // {+var}
+	OpFragment          Operator = '#' // {#var}
+	OpLabel             Operator = '.' // {.var}
+	OpPathSegment       Operator = '/' // {/var}
+	OpPathParameter     Operator = ';' // {;var}
+	OpQuery             Operator = '?' // {?var}
+	OpQueryContinuation Operator = '&' // {&var}
+)
+
+// String returns the operator as it appears in template syntax.
+// The simple string expansion operator is the empty string.
+func (op Operator) String() string {
+	if op == OpSimple {
+		return ""
+	}
+	return string(rune(op))
+}
+
+// Parts returns the literals and expressions that make up the template
+// in the order they appear.
+func (t *Template) Parts() []Part {
+	parts := make([]Part, len(t.parts))
+	for i, p := range t.parts {
+		parts[i] = Part{Pos: p.pos, End: p.end}
+		if p.expr == nil {
+			parts[i].Literal = t.s[p.pos:p.end]
+		} else {
+			parts[i].Expr = &Expression{
+				Operator: p.expr.Operator,
+				Vars:     append([]VarSpec(nil), p.expr.Vars...),
+			}
+		}
+	}
+	return parts
+}
+
+// A Variable is a variable referenced by a template.
+type Variable struct {
+	Name string
+	// Refs is the list of references to the variable
+	// in the order they appear in the template.
+	Refs []VarRef
+}
+
+// A VarRef is a single reference to a variable in a template.
+type VarRef struct {
+	// Operator is the operator of the expression that contains the reference.
+	Operator Operator
+	VarSpec
+}
+
+// Variables returns the variables referenced by the template
+// in the order of their first reference.
+func (t *Template) Variables() []Variable {
+	var vars []Variable
+	indices := make(map[string]int)
+	for _, p := range t.parts {
+		if p.expr == nil {
+			continue
+		}
+		for _, spec := range p.expr.Vars {
+			i, ok := indices[spec.Name]
+			if !ok {
+				i = len(vars)
+				indices[spec.Name] = i
+				vars = append(vars, Variable{Name: spec.Name})
 			}
-			i += len(seq)
+			vars[i].Refs = append(vars[i].Refs, VarRef{
+				Operator: p.expr.Operator,
+				VarSpec:  spec,
+			})
+		}
+	}
+	return vars
+}
+
+// Level returns the lowest RFC 6570 conformance level
+// that supports every expression in the template.
+// A template without expressions is level 1.
+func (t *Template) Level() int {
+	level := 1
+	for _, p := range t.parts {
+		if p.expr != nil && p.expr.Level() > level {
+			level = p.expr.Level()
+		}
+	}
+	return level
+}
+
+// Parse parses a URI template.
+// If the template is malformed, then Parse returns an [ErrorList]
+// that describes every syntax error in the template.
+// See [Expand] for how variables are interpreted during expansion.
+func Parse(template string) (*Template, error) {
+	return new(Expander).Parse(template)
+}
+
+// Parse parses a URI template like [Parse].
+// The returned template uses a copy of the Expander's options
+// whenever it is expanded.
+func (e *Expander) Parse(template string) (*Template, error) {
+	t := &Template{s: template, opts: *e}
+	p := parser{template: template}
+	var errs ErrorList
+	for !p.done() {
+		tok := p.next()
+		switch {
+		case tok.err != nil:
+			errs = append(errs, tok.err)
+		case tok.isExpr:
+			expr := &Expression{
+				Operator: p.expr.Operator,
+				Vars:     append([]VarSpec(nil), p.expr.Vars...),
+			}
+			if e.MaxLevel > 0 && expr.Level() > e.MaxLevel {
+				errs = append(errs, p.errorf(tok.pos, tok.end-tok.pos, ErrLevelExceeded))
+				continue
+			}
+			t.parts = append(t.parts, part{pos: tok.pos, end: tok.end, expr: expr})
 		default:
-			if firstError == nil {
-				firstError = fmt.Errorf("expand uri template %q: illegal character %q", template, c)
+			var buf buffer
+			writeLiteral(&buf, template[tok.pos:tok.end])
+			t.parts = append(t.parts, part{pos: tok.pos, end: tok.end, literal: string(buf)})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return t, nil
+}
+
+// MustParse is like [Parse] but panics if the template cannot be parsed.
+// It simplifies safe initialization of global variables holding templates.
+func MustParse(template string) *Template {
+	t, err := Parse(template)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the source text of the template.
+func (t *Template) String() string {
+	return t.s
+}
+
+// Expand expands the variables in the template.
+// See [Expand] for how data is interpreted.
+// Variables that data does not define are taken from
+// the defaults bound by [Template.With], if any.
+func (t *Template) Expand(data any) (string, error) {
+	return t.ExpandContext(context.Background(), data)
+}
+
+// ExpandContext is like [Template.Expand]
+// but passes ctx to lazy values that accept a [context.Context].
+func (t *Template) ExpandContext(ctx context.Context, data any) (string, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var err error
+	*buf, err = t.appendExpand(ctx, *buf, data)
+	return string(*buf), err
+}
+
+// ExpandTo is like [Template.Expand] but writes the expanded URI to w.
+// If expansion fails, then ExpandTo does not write anything to w.
+func (t *Template) ExpandTo(w io.Writer, data any) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	var err error
+	*buf, err = t.AppendExpand(*buf, data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(*buf)
+	return err
+}
+
+// AppendExpand is like [Template.Expand] but appends the expanded URI to dst
+// and returns the extended buffer.
+func (t *Template) AppendExpand(dst []byte, data any) ([]byte, error) {
+	return t.appendExpand(context.Background(), dst, data)
+}
+
+func (t *Template) appendExpand(ctx context.Context, dst []byte, data any) ([]byte, error) {
+	buf := buffer(dst)
+	x := &expansion{ctx: ctx, data: reflect.ValueOf(t.withDefaults(data))}
+	var firstError error
+	for _, p := range t.parts {
+		if p.expr == nil {
+			buf.WriteString(p.literal)
+			continue
+		}
+		if err := t.opts.expandExpression(&buf, p.expr, x); err != nil && firstError == nil {
+			firstError = fmt.Errorf("expand uri template %q: %w", t.s, err)
+		}
+	}
+	return buf, firstError
+}
+
+// With returns a template that is the same as t
+// but uses data for variables that are not defined
+// by the data passed to expansion.
+// data may be any data accepted by [Expand].
+// If t already has defaults from a previous call to With,
+// then data takes priority over them.
+// t is not modified.
+func (t *Template) With(data any) *Template {
+	defaults := data
+	if t.defaults != nil {
+		defaults = Layers{data, t.defaults}
+	}
+	return &Template{
+		s:        t.s,
+		parts:    t.parts,
+		opts:     t.opts,
+		defaults: defaults,
+	}
+}
+
+// withDefaults returns data layered on top of the template's defaults.
+func (t *Template) withDefaults(data any) any {
+	if t.defaults == nil {
+		return data
+	}
+	return Layers{data, t.defaults}
+}
+
+// buffer is a byte slice that expansion writes to.
+type buffer []byte
+
+func (buf *buffer) WriteString(s string) {
+	*buf = append(*buf, s...)
+}
+
+func (buf *buffer) WriteByte(c byte) error {
+	*buf = append(*buf, c)
+	return nil
+}
+
+var bufferPool sync.Pool
+
+// getBuffer returns an empty buffer from a pool.
+// The caller should call putBuffer when it is done with the buffer.
+func getBuffer() *buffer {
+	buf, _ := bufferPool.Get().(*buffer)
+	if buf == nil {
+		buf = new(buffer)
+	}
+	return buf
+}
+
+func putBuffer(buf *buffer) {
+	// Avoid holding onto unusually large buffers.
+	const maxSize = 64 << 10
+	if cap(*buf) > maxSize {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufferPool.Put(buf)
+}
+
+var varSpecPool sync.Pool
+
+// getVarSpecs returns an empty slice from a pool
+// for parsing the variables of expressions during one-shot expansion.
+// The caller should call putVarSpecs when it is done with the slice.
+func getVarSpecs() *[]VarSpec {
+	vars, _ := varSpecPool.Get().(*[]VarSpec)
+	if vars == nil {
+		vars = new([]VarSpec)
+	}
+	return vars
+}
+
+func putVarSpecs(vars *[]VarSpec) {
+	// Avoid holding onto the template through variable names.
+	all := (*vars)[:cap(*vars)]
+	for i := range all {
+		all[i] = VarSpec{}
+	}
+	*vars = all[:0]
+	varSpecPool.Put(vars)
+}
+
+// parser splits a URI template into tokens.
+type parser struct {
+	template string
+	pos      int
+
+	// expr is the most recently parsed expression.
+	// Its Vars slice is reused between calls to next,
+	// so one-shot expansion starts it with a slice from getVarSpecs
+	// to avoid allocating.
+	expr Expression
+}
+
+// token is a single lexical element of a URI template.
+// If err is not nil, then the token is malformed
+// and err describes the first problem in the token.
+// Otherwise, if isExpr is true, the token is an expression
+// and the parser's expr field holds the parsed expression.
+// Otherwise, the token is a run of literal characters.
+type token struct {
+	pos, end int
+	isExpr   bool
+	err      *SyntaxError
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.template)
+}
+
+func (p *parser) next() token {
+	tok := token{pos: p.pos}
+	for p.pos < len(p.template) {
+		c, size := utf8.DecodeRuneInString(p.template[p.pos:])
+		switch {
+		case isLiteral(c):
+			p.pos += size
+			continue
+		case c == '%':
+			seq, _, ok := cutPercentEscape(p.template[p.pos:])
+			if ok {
+				p.pos += len(seq)
+				continue
 			}
-			i += size
+			if p.pos == tok.pos {
+				p.pos += len(seq)
+				tok.end = p.pos
+				tok.err = p.errorf(tok.pos, len(seq), ErrInvalidPercentEscape)
+				return tok
+			}
+		case p.pos > tok.pos:
+			// Return the literal that precedes the current character.
+		case c == '{':
+			tok.err = p.expression()
+			tok.isExpr = tok.err == nil
+			tok.end = p.pos
+			return tok
+		default:
+			p.pos += size
+			tok.end = p.pos
+			tok.err = p.errorf(tok.pos, size, ErrIllegalCharacter)
+			return tok
 		}
+		break
 	}
-	return sb.String(), firstError
+	tok.end = p.pos
+	return tok
 }
 
-func expandExpression(sb *strings.Builder, expr string, data reflect.Value) (exprLen int, err error) {
+func (p *parser) errorf(pos, n int, code ErrorCode) *SyntaxError {
+	return &SyntaxError{
+		Template: p.template,
+		Offset:   pos,
+		Len:      n,
+		Code:     code,
+	}
+}
+
+// expression parses the expression at the current position into p.expr.
+func (p *parser) expression() *SyntaxError {
+	start := p.pos
+	expr := p.template[start:]
 	end := strings.IndexByte(expr, '}')
 	if end < 0 {
-		sb.WriteString(expr)
-		return len(expr), errors.New("unterminated expression")
+		p.pos = len(p.template)
+		return p.errorf(start, len(expr), ErrUnterminatedExpression)
 	}
-	exprLen = end + 1
-	rest := strings.TrimPrefix(expr[:end], "{")
+	p.pos += end + 1
+	expr = expr[:end+1]
+	rest := expr[1:end]
+	// offset returns the position in the template of the remaining expression.
+	offset := func() int { return start + end - len(rest) }
 
-	var op byte
+	e := &p.expr
+	e.Operator = OpSimple
+	e.Vars = e.Vars[:0]
 	const reservedOps = "=,!@|"
 	if len(rest) > 0 && strings.IndexByte("+#./;?&"+reservedOps, rest[0]) != -1 {
-		op = rest[0]
+		e.Operator = Operator(rest[0])
 		rest = rest[1:]
 	}
 
 	if rest == "" {
-		sb.WriteString(expr[:exprLen])
-		return exprLen, errors.New("empty expression")
-	}
-	if strings.IndexByte(reservedOps, op) != -1 {
-		sb.WriteString(expr[:exprLen])
-		return exprLen, fmt.Errorf("expression %q: unknown operator %q", expr, op)
+		return p.errorf(start, len(expr), ErrEmptyExpression)
 	}
-	varName, modifier, rest := cutVarSpec(rest)
-	if varName == "" {
-		sb.WriteString(expr[:exprLen])
-		return exprLen, fmt.Errorf("expression %q: missing variable name", expr)
+	if strings.IndexByte(reservedOps, byte(e.Operator)) != -1 {
+		return p.errorf(start+1, 1, ErrUnknownOperator)
 	}
-	first, err := expandVariable(sb, op, true, data, varName, modifier)
-	if err != nil {
-		writeRemainingExpression(sb, op, rest)
-		return exprLen, fmt.Errorf("expression %q: %v", expr, err)
-	}
-
-	for len(rest) > 0 {
-		if rest[0] != ',' {
-			writeRemainingExpression(sb, op, rest)
-			return exprLen, fmt.Errorf("expression %q: unexpected character %q", expr, rest[0])
+	for {
+		spec := VarSpec{Pos: offset()}
+		var modifier string
+		spec.Name, modifier, rest = cutVarSpec(rest)
+		if spec.Name == "" {
+			return p.errorf(spec.Pos, 1, ErrMissingVariableName)
 		}
-		rest = rest[1:]
+		if modifier == "*" {
+			spec.Explode = true
+		} else if modifier != "" {
+			spec.MaxLength, _ = strconv.Atoi(modifier[1:])
+		}
+		spec.End = offset()
+		e.Vars = append(e.Vars, spec)
 
-		varName, modifier, rest = cutVarSpec(rest)
-		if varName == "" {
-			writeRemainingExpression(sb, op, rest)
-			return exprLen, fmt.Errorf("expression %q: missing variable name", expr)
+		if rest == "" {
+			return nil
 		}
-		first, err = expandVariable(sb, op, first, data, varName, modifier)
-		if err != nil {
-			writeRemainingExpression(sb, op, rest)
-			return exprLen, fmt.Errorf("expression %q: %v", expr, err)
+		if rest[0] != ',' {
+			return p.errorf(offset(), 1, ErrUnexpectedCharacter)
 		}
+		rest = rest[1:]
 	}
-
-	return exprLen, nil
 }
 
-func writeRemainingExpression(sb *strings.Builder, op byte, rest string) {
-	if rest == "" {
-		return
-	}
-	sb.WriteString("{")
-	if op != 0 {
-		sb.WriteByte(op)
+func (e *Expander) expandExpression(buf *buffer, expr *Expression, x *expansion) error {
+	first := true
+	for _, spec := range expr.Vars {
+		var err error
+		first, err = e.expandVariable(buf, expr.Operator, first, x, spec)
+		if err != nil {
+			return &ValueError{Name: spec.Name, Err: err}
+		}
 	}
-	sb.WriteString(rest)
-	sb.WriteString("}")
+	return nil
 }
 
 func cutVarSpec(expr string) (varName, modifier, rest string) {
@@ -235,11 +1002,30 @@ func cutPercentEscape(s string) (pct, rest string, ok bool) {
 	return s[:escapeLen], s[escapeLen:], isHex(s[1]) && isHex(s[2])
 }
 
-func percentEscape(sb *strings.Builder, s string) {
+// writeLiteral writes a run of literal template characters to buf,
+// percent-encoding any characters that are not allowed in a URI.
+func writeLiteral(buf *buffer, s string) {
+	for len(s) > 0 {
+		if pct, rest, ok := cutPercentEscape(s); ok {
+			buf.WriteString(pct)
+			s = rest
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s)
+		if literalNeedsPercentEscape(c) {
+			percentEscape(buf, s[:size])
+		} else {
+			buf.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+}
+
+func percentEscape(buf *buffer, s string) {
 	for _, b := range []byte(s) {
-		sb.WriteByte('%')
-		sb.WriteByte(upperHex(b >> 4))
-		sb.WriteByte(upperHex(b & 0x0f))
+		buf.WriteByte('%')
+		buf.WriteByte(upperHex(b >> 4))
+		buf.WriteByte(upperHex(b & 0x0f))
 	}
 }
 
@@ -275,6 +1061,13 @@ func upperHex(x byte) byte {
 	return '0' + x
 }
 
+func lowerHex(x byte) byte {
+	if x >= 0xa {
+		return 'a' + (x - 0xa)
+	}
+	return '0' + x
+}
+
 func isHex(c byte) bool {
 	return isDigit(rune(c)) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
 }
@@ -16,7 +16,16 @@
 
 package uritemplate
 
-import "testing"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 var keysData = struct {
 	Semi  string
@@ -586,6 +595,1154 @@ func TestExpand(t *testing.T) {
 	}
 }
 
+func TestTemplateExpand(t *testing.T) {
+	for _, test := range tests {
+		tmpl, err := Parse(test.template)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.template, err)
+			continue
+		}
+		got, err := tmpl.Expand(test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Parse(%q).Expand(%#v) = %q, %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestAppendExpand(t *testing.T) {
+	prefix := []byte("https://example.com")
+	for _, test := range tests {
+		got, err := AppendExpand(prefix[:len(prefix):len(prefix)], test.template, test.data)
+		if want := string(prefix) + test.want; string(got) != want || err != nil {
+			t.Errorf("AppendExpand(%q, %q, %#v) = %q, %v; want %q, <nil>",
+				prefix, test.template, test.data, got, err, want)
+		}
+	}
+}
+
+func TestExpandTo(t *testing.T) {
+	for _, test := range tests {
+		sb := new(strings.Builder)
+		err := MustParse(test.template).ExpandTo(sb, test.data)
+		if got := sb.String(); got != test.want || err != nil {
+			t.Errorf("Parse(%q).ExpandTo(w, %#v) wrote %q, returned %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+
+	sb := new(strings.Builder)
+	if err := ExpandTo(sb, "/{x}", map[string]any{"x": failingMarshaler{}}); err == nil {
+		t.Error("ExpandTo with failing value did not return an error")
+	}
+	if sb.Len() > 0 {
+		t.Errorf("ExpandTo with failing value wrote %q; want nothing", sb.String())
+	}
+}
+
+type sourceMap map[string]any
+
+func (m sourceMap) Lookup(name string) (any, bool) {
+	v, ok := m["source:"+name]
+	return v, ok
+}
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		template string
+		data     any
+		want     string
+	}{
+		{
+			template: "/users/{id}{?page}",
+			data: SourceFunc(func(name string) (any, bool) {
+				if name == "id" {
+					return 42, true
+				}
+				return nil, false
+			}),
+			want: "/users/42",
+		},
+		{
+			template: "{?x,list*}",
+			data: sourceMap{
+				"source:x":    "y",
+				"source:list": []string{"a", "b"},
+				"x":           "wrong",
+			},
+			want: "?x=y&list=a&list=b",
+		},
+		{
+			template: "{x}",
+			data:     &sourceMap{"source:x": "y"},
+			want:     "y",
+		},
+		{
+			template: "{x}",
+			data:     (*sourceMap)(nil),
+			want:     "",
+		},
+		{
+			template: "{x}",
+			data:     SourceFunc(nil),
+			want:     "",
+		},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %#v) = %q, %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestMultiValueMap(t *testing.T) {
+	tests := []struct {
+		template string
+		data     any
+		want     string
+	}{
+		{
+			template: "/search{?q,tag}",
+			data:     url.Values{"q": {"go"}, "tag": {"a", "b"}},
+			want:     "/search?q=go&tag=a,b",
+		},
+		{
+			template: "/search{?q*,tag*}",
+			data:     url.Values{"q": {"go"}, "tag": {"a", "b"}},
+			want:     "/search?q=go&tag=a&tag=b",
+		},
+		{
+			template: "{q:3}",
+			data:     url.Values{"q": {"golang"}},
+			want:     "gol",
+		},
+		{
+			template: "{?h}",
+			data:     http.Header{"h": {"x y"}},
+			want:     "?h=x%20y",
+		},
+		{
+			template: "/search{?params*}",
+			data: map[string]any{
+				"params": url.Values{"q": {"go"}, "tag": {"a", "b"}},
+			},
+			want: "/search?q=go&tag=a&tag=b",
+		},
+		{
+			template: "/search{?params}",
+			data: map[string]any{
+				"params": url.Values{"q": {"go"}, "tag": {"a", "b"}},
+			},
+			want: "/search?params=q,go,tag,a,tag,b",
+		},
+		{
+			template: "{params*}",
+			data: map[string]any{
+				"params": url.Values{"empty": {}, "x": {"1"}},
+			},
+			want: "x=1",
+		},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %v) = %q, %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestEmptyComposites(t *testing.T) {
+	data := map[string]any{
+		"x":      "1",
+		"list":   []string{},
+		"nils":   []any{nil},
+		"keys":   map[string]string{},
+		"params": url.Values{"empty": {}},
+		"none":   struct{}{},
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"X{.keys}", "X"},
+		{"X{.keys*}", "X"},
+		{"{?list}", ""},
+		{"{?list*}", ""},
+		{"{?list,x}", "?x=1"},
+		{"{?list*,x}", "?x=1"},
+		{"{/nils}", ""},
+		{"{;params}", ""},
+		{"{?x,params*}", "?x=1"},
+		{"{&none}", ""},
+		{"{list}{+keys*}{#params}", ""},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, data) = %q, %v; want %q, <nil>", test.template, got, err, test.want)
+		}
+	}
+}
+
+type Pagination struct {
+	Page  int
+	Limit int
+}
+
+type pageToken struct {
+	Token string
+	Page  string
+}
+
+func TestInlineStruct(t *testing.T) {
+	type conflictA struct{ Sort string }
+	type conflictB struct{ Sort string }
+	type taggedA struct {
+		Sort string `uritemplate:"sort"`
+	}
+	tests := []struct {
+		template string
+		data     any
+		want     string
+	}{
+		{
+			template: "/items{?q,page,limit}",
+			data: struct {
+				Pagination `uritemplate:",inline"`
+				Q          string
+			}{Pagination{Page: 2, Limit: 10}, "go"},
+			want: "/items?q=go&page=2&limit=10",
+		},
+		{
+			template: "/items{?params*}",
+			data: map[string]any{
+				"params": struct {
+					Q           string
+					*Pagination `uritemplate:",inline"`
+				}{"go", &Pagination{Page: 2, Limit: 10}},
+			},
+			want: "/items?q=go&page=2&limit=10",
+		},
+		{
+			// Nil embedded pointers hide their fields.
+			template: "/items{?q,page}",
+			data: struct {
+				Q           string
+				*Pagination `uritemplate:",inline"`
+			}{Q: "go"},
+			want: "/items?q=go",
+		},
+		{
+			// Without the inline option, embedded structs are ordinary fields.
+			template: "/items{?pagination*}",
+			data: struct {
+				Pagination
+			}{Pagination{Page: 2, Limit: 10}},
+			want: "/items?page=2&limit=10",
+		},
+		{
+			// Unexported embedded structs can be inlined.
+			template: "{?token,page}",
+			data: struct {
+				pageToken `uritemplate:",inline"`
+			}{pageToken{Token: "abc", Page: "x"}},
+			want: "?token=abc&page=x",
+		},
+		{
+			// Shallower fields hide deeper ones.
+			template: "{?page,limit}",
+			data: struct {
+				Pagination `uritemplate:",inline"`
+				Page       string
+			}{Pagination{Page: 2, Limit: 10}, "first"},
+			want: "?page=first&limit=10",
+		},
+		{
+			// Conflicting fields at the same depth are ignored.
+			template: "{?sort,params*}",
+			data: map[string]any{
+				"sort": "outer",
+				"params": struct {
+					conflictA `uritemplate:",inline"`
+					conflictB `uritemplate:",inline"`
+				}{conflictA{"a"}, conflictB{"b"}},
+			},
+			want: "?sort=outer",
+		},
+		{
+			// Tagged fields win conflicts at the same depth.
+			template: "{?params*}",
+			data: map[string]any{
+				"params": struct {
+					conflictA `uritemplate:",inline"`
+					taggedA   `uritemplate:",inline"`
+				}{conflictA{"a"}, taggedA{"tagged"}},
+			},
+			want: "?sort=tagged",
+		},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %+v) = %q, %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+func TestStructTagOptions(t *testing.T) {
+	type params struct {
+		Q      string   `uritemplate:"q,omitempty"`
+		Page   int      `uritemplate:"page,omitempty"`
+		Tags   []string `uritemplate:"tag,explode"`
+		Fields []string `uritemplate:"fields,noexplode"`
+		Point  [2]int   `uritemplate:"point,string"`
+		Ptr    *int     `uritemplate:",omitempty"`
+	}
+	zero := 0
+	tests := []struct {
+		template string
+		data     any
+		want     string
+	}{
+		{
+			template: "/search{?q,page}",
+			data:     params{},
+			want:     "/search",
+		},
+		{
+			template: "/search{?q,page}",
+			data:     params{Q: "go", Page: 2},
+			want:     "/search?q=go&page=2",
+		},
+		{
+			template: "/search{?tag}",
+			data:     params{Tags: []string{"a", "b"}},
+			want:     "/search?tag=a&tag=b",
+		},
+		{
+			template: "/search{?fields*}",
+			data:     params{Fields: []string{"a", "b"}},
+			want:     "/search?fields=a,b",
+		},
+		{
+			template: "{point}",
+			data:     params{Point: [2]int{1, 2}},
+			want:     "%5B1%202%5D",
+		},
+		{
+			template: "{point:2}",
+			data:     params{Point: [2]int{1, 2}},
+			want:     "%5B1",
+		},
+		{
+			template: "{?ptr}",
+			data:     params{Ptr: &zero},
+			want:     "?ptr=0",
+		},
+		{
+			template: "{?p*}",
+			data:     map[string]any{"p": params{Q: "go", Point: [2]int{1, 2}}},
+			want:     "?q=go&point=%5B1%202%5D",
+		},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %+v) = %q, %v; want %q, <nil>",
+				test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+type stringSet []string
+
+func (set stringSet) ListValue(yield func(string) bool) error {
+	for _, elem := range set {
+		if !yield(elem) {
+			break
+		}
+	}
+	return nil
+}
+
+// String is ignored in favor of ListValue.
+func (set stringSet) String() string {
+	return "set"
+}
+
+type orderedMap [][2]string
+
+func (m orderedMap) MapValue(yield func(k, v string) bool) error {
+	for _, kv := range m {
+		if !yield(kv[0], kv[1]) {
+			break
+		}
+	}
+	return nil
+}
+
+type listFunc func(yield func(string) bool) error
+
+func (f listFunc) ListValue(yield func(string) bool) error {
+	return f(yield)
+}
+
+type failingList struct{}
+
+func (failingList) ListValue(yield func(string) bool) error {
+	yield("a")
+	return errMarshal
+}
+
+func TestValuers(t *testing.T) {
+	data := map[string]any{
+		"set":    stringSet{"red", "green"},
+		"empty":  stringSet{},
+		"m":      orderedMap{{"z", "1"}, {"a", "2"}},
+		"nested": map[string]any{"colors": stringSet{"red", "blue"}},
+		"ptr":    (*orderedMap)(nil),
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{set}", "red,green"},
+		{"{/set*}", "/red/green"},
+		{"{?set*}", "?set=red&set=green"},
+		{"{?empty*}", ""},
+		{"{;empty}", ""},
+		{"{m}", "z,1,a,2"},
+		{"{m*}", "z=1,a=2"},
+		{"{?m*}", "?z=1&a=2"},
+		{"{?nested*}", "?colors=red&colors=blue"},
+		{"{?ptr*}", ""},
+		{"{?ptr}", ""},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, data) = %q, %v; want %q, <nil>", test.template, got, err, test.want)
+		}
+	}
+
+	var nilValuers struct {
+		L ListValuer
+		M MapValuer
+	}
+	for _, template := range []string{"{l}", "{?l*}", "{m}", "{?m*}"} {
+		got, err := Expand(template, nilValuers)
+		if got != "" || err != nil {
+			t.Errorf("Expand(%q, nilValuers) = %q, %v; want \"\", <nil>", template, got, err)
+		}
+	}
+
+	if _, err := Expand("{x}", map[string]any{"x": failingList{}}); !errors.Is(err, errMarshal) {
+		t.Errorf("Expand(\"{x}\", failingList) error = %v; want %v", err, errMarshal)
+	}
+
+	// Iteration stops at the first element that cannot be formatted.
+	var yielded []string
+	list := listFunc(func(yield func(string) bool) error {
+		for _, elem := range []string{"a", "bad", "c"} {
+			yielded = append(yielded, elem)
+			if !yield(elem) {
+				break
+			}
+		}
+		return nil
+	})
+	e := &Expander{Format: func(v any) (string, bool, error) {
+		if v == "bad" {
+			return "", false, errMarshal
+		}
+		return "", false, nil
+	}}
+	if _, err := e.Expand("{x}", map[string]any{"x": list}); !errors.Is(err, errMarshal) {
+		t.Errorf("Expand(\"{x}\", list) error = %v; want %v", err, errMarshal)
+	}
+	if want := []string{"a", "bad"}; !reflect.DeepEqual(yielded, want) {
+		t.Errorf("ListValue yielded %q; want %q", yielded, want)
+	}
+}
+
+func TestPairs(t *testing.T) {
+	params := Pairs{
+		{"z", "last"},
+		{"a", 1},
+		{"tags", []string{"x", "y"}},
+		{"nil", nil},
+	}
+	tests := []struct {
+		template string
+		data     any
+		want     string
+	}{
+		{"/sign{?params*}", map[string]any{"params": params}, "/sign?z=last&a=1&tags=x&tags=y"},
+		{"/sign{?params}", map[string]any{"params": params}, "/sign?params=z,last,a,1,tags,x,tags,y"},
+		{"{/z,a}{?nil}", params, "/last/1"},
+		{"{x}", Pairs{{"x", "first"}, {"x", "second"}}, "first"},
+		{"{?p*}", map[string]any{"p": []Pair{{"b", "2"}, {"a", "1"}}}, "?b=2&a=1"},
+		{"{?p*}", map[string]any{"p": Pairs{}}, ""},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %v) = %q, %v; want %q, <nil>", test.template, test.data, got, err, test.want)
+		}
+	}
+}
+
+type namedBool bool
+
+func TestSequences(t *testing.T) {
+	colors := func(yield func(string) bool) {
+		for _, c := range []string{"red", "green", "blue"} {
+			if !yield(c) {
+				return
+			}
+		}
+	}
+	counts := func(yield func(*int) bool) {
+		one, two := 1, 2
+		_ = yield(&one) && yield(nil) && yield(&two)
+	}
+	params := func(yield func(string, any) bool) {
+		_ = yield("z", 1) && yield("a", []string{"x", "y"}) && yield("nil", nil)
+	}
+	var nilSeq func(yield func(string) bool)
+	namedBoolSeq := func(yield func(string) namedBool) {
+		yield("x")
+	}
+	data := map[string]any{
+		"colors": colors,
+		"counts": counts,
+		"params": params,
+		"nil":    nilSeq,
+		"named":  namedBoolSeq,
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"{colors}", "red,green,blue"},
+		{"{/colors*}", "/red/green/blue"},
+		{"{?counts}", "?counts=1,2"},
+		{"{?params*}", "?z=1&a=x&a=y"},
+		{"{params}", "z,1,a,x,a,y"},
+		{"{?nil}", ""},
+		// Only iterator functions with a yield function returning bool are sequences.
+		{"{named}", fmt.Sprintf("%p", namedBoolSeq)},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, data) = %q, %v; want %q, <nil>", test.template, got, err, test.want)
+		}
+	}
+
+	// Iteration stops at the first element that cannot be formatted.
+	var yielded []string
+	e := &Expander{Format: func(v any) (string, bool, error) {
+		if v == "green" {
+			return "", false, errMarshal
+		}
+		return "", false, nil
+	}}
+	recorded := func(yield func(string) bool) {
+		colors(func(c string) bool {
+			yielded = append(yielded, c)
+			return yield(c)
+		})
+	}
+	if _, err := e.Expand("{colors}", map[string]any{"colors": recorded}); !errors.Is(err, errMarshal) {
+		t.Errorf("Expand(\"{colors}\", recorded) error = %v; want %v", err, errMarshal)
+	}
+	if want := []string{"red", "green"}; !reflect.DeepEqual(yielded, want) {
+		t.Errorf("sequence yielded %q; want %q", yielded, want)
+	}
+}
+
+type ctxKey struct{}
+
+func TestLazyValues(t *testing.T) {
+	calls := 0
+	errToken := errors.New("token unavailable")
+	data := map[string]any{
+		"slug": func() (any, error) {
+			calls++
+			return "hello-world", nil
+		},
+		"tags": func() ([]string, error) {
+			return []string{"a", "b"}, nil
+		},
+		"user": func(ctx context.Context) (any, error) {
+			return map[string]any{"id": ctx.Value(ctxKey{})}, nil
+		},
+		"undefined": func() (any, error) {
+			return nil, nil
+		},
+		"token": func() (any, error) {
+			t.Error("token called without being referenced")
+			return nil, errToken
+		},
+		"bad": func() (string, error) {
+			return "", errToken
+		},
+	}
+	ctx := context.WithValue(context.Background(), ctxKey{}, 42)
+
+	got, err := ExpandContext(ctx, "/posts/{slug}{?tags*,undefined}#{slug}", data)
+	if want := "/posts/hello-world?tags=a&tags=b#hello-world"; got != want || err != nil {
+		t.Errorf("ExpandContext(...) = %q, %v; want %q, <nil>", got, err, want)
+	}
+	if calls != 1 {
+		t.Errorf("slug called %d times; want 1", calls)
+	}
+
+	e := &Expander{NestedNames: true}
+	got, err = e.ExpandContext(ctx, "/users/{user.id}", data)
+	if want := "/users/42"; got != want || err != nil {
+		t.Errorf("(&Expander{NestedNames: true}).ExpandContext(...) = %q, %v; want %q, <nil>", got, err, want)
+	}
+
+	_, err = MustParse("/{slug}/{bad}").ExpandContext(ctx, data)
+	var valueErr *ValueError
+	if !errors.As(err, &valueErr) || valueErr.Name != "bad" || !errors.Is(err, errToken) {
+		t.Errorf("MustParse(\"/{slug}/{bad}\").ExpandContext(...) error = %v; want ValueError for bad wrapping %v", err, errToken)
+	}
+}
+
+func TestLayers(t *testing.T) {
+	defaults := map[string]any{
+		"host":    "api.example.com",
+		"version": "v1",
+		"page":    1,
+	}
+	type request struct {
+		Version string `uritemplate:"version,omitempty"`
+		Page    *int   `uritemplate:"page"`
+		ID      int    `uritemplate:"id"`
+	}
+	tests := []struct {
+		template string
+		data     Layers
+		want     string
+	}{
+		{
+			template: "https://{host}/{version}/items/{id}{?page}",
+			data:     Layers{request{ID: 7}, defaults},
+			want:     "https://api.example.com/v1/items/7?page=1",
+		},
+		{
+			template: "https://{host}/{version}/items{?page}",
+			data: Layers{
+				map[string]any{"version": "v2", "page": 3},
+				defaults,
+			},
+			want: "https://api.example.com/v2/items?page=3",
+		},
+		{
+			template: "{a},{b},{c}",
+			data: Layers{
+				Layers{map[string]any{"a": "1"}, nil},
+				SourceFunc(func(name string) (any, bool) {
+					return name + "!", name == "b"
+				}),
+				Pairs{{"a", "unused"}, {"c", "3"}},
+			},
+			want: "1,b%21,3",
+		},
+	}
+	for _, test := range tests {
+		got, err := Expand(test.template, test.data)
+		if got != test.want || err != nil {
+			t.Errorf("Expand(%q, %v) = %q, %v; want %q, <nil>", test.template, test.data, got, err, test.want)
+		}
+	}
+
+	// A pointer to Layers uses the Expander's options.
+	e := &Expander{FieldNaming: SnakeCase}
+	type params struct {
+		PageSize int
+		Tags     []string `uritemplate:",explode"`
+	}
+	layers := &Layers{params{PageSize: 3, Tags: []string{"a", "b"}}}
+	if got, err := e.Expand("{page_size}{?tags}", layers); got != "3?tags=a&tags=b" || err != nil {
+		t.Errorf("(%+v).Expand(\"{page_size}{?tags}\", &Layers{...}) = %q, %v; want \"3?tags=a&tags=b\", <nil>", *e, got, err)
+	}
+
+	v, ok := Layers{nil, map[string]int{"x": 1}}.Lookup("x")
+	if v != 1 || !ok {
+		t.Errorf("Layers{...}.Lookup(\"x\") = %v, %t; want 1, true", v, ok)
+	}
+	if v, ok := (Layers{defaults}).Lookup("missing"); ok {
+		t.Errorf("Layers{...}.Lookup(\"missing\") = %v, %t; want <nil>, false", v, ok)
+	}
+}
+
+func TestTemplateWith(t *testing.T) {
+	base := MustParse("https://{host}/{version}/items{/id}{?page}")
+	v1 := base.With(map[string]any{"host": "api.example.com", "version": "v1"})
+	v2 := v1.With(map[string]any{"version": "v2"})
+
+	tests := []struct {
+		tmpl *Template
+		data any
+		want string
+	}{
+		{base, map[string]any{"id": 7}, "https:////items/7"},
+		{v1, map[string]any{"id": 7}, "https://api.example.com/v1/items/7"},
+		{v1, map[string]any{"id": 7, "version": "beta"}, "https://api.example.com/beta/items/7"},
+		{v1, nil, "https://api.example.com/v1/items"},
+		{v2, struct{ Page int }{2}, "https://api.example.com/v2/items?page=2"},
+	}
+	for _, test := range tests {
+		got, err := test.tmpl.Expand(test.data)
+		if got != test.want || err != nil {
+			t.Errorf("%v.Expand(%v) = %q, %v; want %q, <nil>", test.tmpl, test.data, got, err, test.want)
+		}
+	}
+	if got, want := v2.String(), base.String(); got != want {
+		t.Errorf("v2.String() = %q; want %q", got, want)
+	}
+	values, err := v2.Match("https://example.com/v3/items/9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := values["version"].String(); got != "v3" {
+		t.Errorf(`v2.Match(...)["version"] = %q; want "v3"`, got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		template string
+		offset   int
+		len      int
+		code     ErrorCode
+	}{
+		{"/{", 1, 1, ErrUnterminatedExpression},
+		{"/{x", 1, 2, ErrUnterminatedExpression},
+		{"{}", 0, 2, ErrEmptyExpression},
+		{"{+}", 0, 3, ErrEmptyExpression},
+		{"{=x}", 1, 1, ErrUnknownOperator},
+		{"{x,}", 3, 1, ErrMissingVariableName},
+		{"{x:0}", 2, 1, ErrUnexpectedCharacter},
+		{"{x*y}", 3, 1, ErrUnexpectedCharacter},
+		{"foo bar", 3, 1, ErrIllegalCharacter},
+		{"/%zz", 1, 3, ErrInvalidPercentEscape},
+		{"%2", 0, 2, ErrInvalidPercentEscape},
+	}
+	for _, test := range tests {
+		tmpl, err := Parse(test.template)
+		if err == nil {
+			t.Errorf("Parse(%q) = %q, <nil>; want error", test.template, tmpl)
+			continue
+		}
+		var syntaxError *SyntaxError
+		if !errors.As(err, &syntaxError) {
+			t.Errorf("Parse(%q) error = %v; want *SyntaxError", test.template, err)
+			continue
+		}
+		if syntaxError.Offset != test.offset || syntaxError.Len != test.len || syntaxError.Code != test.code {
+			t.Errorf("Parse(%q) error = %+v; want {Offset:%d Len:%d Code:%v}",
+				test.template, syntaxError, test.offset, test.len, test.code)
+		}
+	}
+}
+
+func TestParseMultipleErrors(t *testing.T) {
+	const template = "/a%zz/{=x}/{y"
+	_, err := Parse(template)
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("Parse(%q) error = %v; want ErrorList", template, err)
+	}
+	want := []struct {
+		offset int
+		code   ErrorCode
+	}{
+		{2, ErrInvalidPercentEscape},
+		{7, ErrUnknownOperator},
+		{11, ErrUnterminatedExpression},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("Parse(%q) returned %d errors; want %d", template, len(list), len(want))
+	}
+	for i, w := range want {
+		if list[i].Offset != w.offset || list[i].Code != w.code {
+			t.Errorf("errors[%d] = %+v; want {Offset:%d Code:%v}", i, list[i], w.offset, w.code)
+		}
+	}
+}
+
+func TestTemplateLevel(t *testing.T) {
+	tests := []struct {
+		template string
+		want     int
+	}{
+		{"", 1},
+		{"/foo", 1},
+		{"/{var}", 1},
+		{"{+path}/here", 2},
+		{"X{#var}", 2},
+		{"{var}{+path}", 2},
+		{"{x,y}", 3},
+		{"{+x,hello}", 3},
+		{"X{.var}", 3},
+		{"{/var}", 3},
+		{"{;x}", 3},
+		{"{?x}", 3},
+		{"?fixed=yes{&x}", 3},
+		{"{var:3}", 4},
+		{"{list*}", 4},
+		{"{?x,list*}", 4},
+		{"{var}{/path:6}", 4},
+	}
+	for _, test := range tests {
+		tmpl, err := Parse(test.template)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.template, err)
+			continue
+		}
+		if got := tmpl.Level(); got != test.want {
+			t.Errorf("Parse(%q).Level() = %d; want %d", test.template, got, test.want)
+		}
+	}
+}
+
+func TestExpanderMaxLevel(t *testing.T) {
+	e := &Expander{MaxLevel: 2}
+	for _, template := range []string{"/foo", "/{var}", "{+path}{#frag}"} {
+		if _, err := e.Parse(template); err != nil {
+			t.Errorf("Parse(%q): %v", template, err)
+		}
+	}
+
+	const template = "/{x}{/y}{+z}{?q*}"
+	_, err := e.Parse(template)
+	var list ErrorList
+	if !errors.As(err, &list) {
+		t.Fatalf("Parse(%q) error = %v; want ErrorList", template, err)
+	}
+	want := []struct {
+		offset int
+		len    int
+	}{
+		{4, 4},
+		{12, 5},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("Parse(%q) returned %d errors; want %d", template, len(list), len(want))
+	}
+	for i, w := range want {
+		if list[i].Offset != w.offset || list[i].Len != w.len || list[i].Code != ErrLevelExceeded {
+			t.Errorf("errors[%d] = %+v; want {Offset:%d Len:%d Code:%v}",
+				i, list[i], w.offset, w.len, ErrLevelExceeded)
+		}
+	}
+}
+
+type failingMarshaler struct{}
+
+var errMarshal = errors.New("bork")
+
+func (failingMarshaler) MarshalText() ([]byte, error) {
+	return nil, errMarshal
+}
+
+func TestValueError(t *testing.T) {
+	_, err := MustParse("/{x}{y}").Expand(map[string]any{
+		"x": "foo",
+		"y": failingMarshaler{},
+	})
+	var valueError *ValueError
+	if !errors.As(err, &valueError) || valueError.Name != "y" || !errors.Is(err, errMarshal) {
+		t.Errorf("Expand(...) error = %v; want *ValueError for y wrapping %v", err, errMarshal)
+	}
+}
+
+func TestExpanderStrict(t *testing.T) {
+	e := &Expander{Strict: true}
+	for _, template := range []string{"/users/{id}", "{?x,undef}", "{/missing*}", "{?emptyKeys}"} {
+		_, err := e.Expand(template, expansionSectionData)
+		var valueError *ValueError
+		if !errors.Is(err, ErrUndefined) || !errors.As(err, &valueError) {
+			t.Errorf("Expand(%q, ...) error = %v; want *ValueError wrapping %v", template, err, ErrUndefined)
+		}
+	}
+
+	tmpl, err := e.Parse("/users/{id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tmpl.Expand(struct{ Iid int }{42}); !errors.Is(err, ErrUndefined) {
+		t.Errorf("Expand(...) = %q, %v; want _, %v", got, err, ErrUndefined)
+	}
+	if got, err := tmpl.Expand(map[string]int{"id": 42}); got != "/users/42" || err != nil {
+		t.Errorf("Expand(...) = %q, %v; want \"/users/42\", <nil>", got, err)
+	}
+
+	// Defined variables, even if empty, expand without error.
+	for _, test := range tests {
+		if _, err := e.Expand(test.template, test.data); err != nil && !errors.Is(err, ErrUndefined) {
+			t.Errorf("Expand(%q, ...) = _, %v", test.template, err)
+		}
+	}
+	if got, err := e.Expand("O{empty}X", expansionSectionData); got != "OX" || err != nil {
+		t.Errorf("Expand(...) = %q, %v; want \"OX\", <nil>", got, err)
+	}
+}
+
+func TestExpanderNestedNames(t *testing.T) {
+	type user struct {
+		Id      int `uritemplate:"id"`
+		Profile *struct {
+			Name string
+		}
+	}
+	data := map[string]any{
+		"user": &user{
+			Id: 42,
+			Profile: &struct{ Name string }{
+				Name: "Alice",
+			},
+		},
+		"config": map[string]any{
+			"a.b": "literal",
+			"a":   map[string]string{"b": "nested"},
+		},
+		"x.y": "dotted",
+		"x":   map[string]string{"y": "shadowed"},
+		"src": SourceFunc(func(name string) (any, bool) {
+			return "src-" + name, true
+		}),
+	}
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"/users/{user.id}", "/users/42"},
+		{"{user.profile.name}", "Alice"},
+		{"{user.missing}", ""},
+		{"{missing.id}", ""},
+		{"{config.a.b}", "literal"},
+		{"{x.y}", "dotted"},
+		{"{src.key}", "src-key"},
+		{"{?user.id,user.profile.name}", "?user.id=42&user.profile.name=Alice"},
+	}
+	e := &Expander{NestedNames: true}
+	for _, test := range tests {
+		got, err := e.Expand(test.template, data)
+		if got != test.want || err != nil {
+			t.Errorf("(&Expander{NestedNames: true}).Expand(%q, data) = %q, %v; want %q, <nil>",
+				test.template, got, err, test.want)
+		}
+	}
+
+	if got, err := Expand("{user.id}", data); got != "" || err != nil {
+		t.Errorf("Expand(\"{user.id}\", data) = %q, %v; want \"\", <nil>", got, err)
+	}
+}
+
+func TestExpanderFieldNaming(t *testing.T) {
+	type params struct {
+		PageSize   int
+		UserID     string
+		HTTPServer string
+		Page2Token string
+		Sort_Order string
+		Tagged     string `uritemplate:"t"`
+		JSON       string `json:"j,omitempty"`
+		Hidden     string `json:"-"`
+	}
+	data := map[string]any{
+		"p": params{10, "u", "h", "x", "asc", "tag", "json", "hidden"},
+	}
+	tests := []struct {
+		e    *Expander
+		want string
+	}{
+		{
+			e:    &Expander{},
+			want: "?pageSize=10&userID=u&hTTPServer=h&page2Token=x&sort_Order=asc&t=tag&jSON=json&hidden=hidden",
+		},
+		{
+			e:    &Expander{FieldNaming: SnakeCase},
+			want: "?page_size=10&user_id=u&http_server=h&page2_token=x&sort_order=asc&t=tag&json=json&hidden=hidden",
+		},
+		{
+			e:    &Expander{FieldNaming: KebabCase, JSONTags: true},
+			want: "?page-size=10&user-id=u&http-server=h&page2-token=x&sort-order=asc&t=tag&j=json",
+		},
+		{
+			e:    &Expander{FieldNaming: ExactNames},
+			want: "?PageSize=10&UserID=u&HTTPServer=h&Page2Token=x&Sort_Order=asc&t=tag&JSON=json&Hidden=hidden",
+		},
+	}
+	for _, test := range tests {
+		got, err := test.e.Expand("{?p*}", data)
+		if got != test.want || err != nil {
+			t.Errorf("(%+v).Expand(\"{?p*}\", data) = %q, %v; want %q, <nil>", *test.e, got, err, test.want)
+		}
+	}
+
+	e := &Expander{FieldNaming: SnakeCase}
+	if got, err := e.Expand("{?page_size}", params{PageSize: 20}); got != "?page_size=20" || err != nil {
+		t.Errorf("(%+v).Expand(\"{?page_size}\", ...) = %q, %v; want \"?page_size=20\", <nil>", *e, got, err)
+	}
+}
+
+func TestExpanderJSONTagOptions(t *testing.T) {
+	type embedded struct {
+		Inner string
+	}
+	type params struct {
+		Page     int      `json:"page,omitempty"`
+		Tags     []string `json:"tags,string"`
+		embedded `json:",inline"`
+	}
+	data := params{Tags: []string{"a", "b"}, embedded: embedded{Inner: "x"}}
+	e := &Expander{JSONTags: true}
+	const template = "{?page,tags*,inner}"
+	const want = "?page=0&tags=a&tags=b"
+	if got, err := e.Expand(template, data); got != want || err != nil {
+		t.Errorf("(%+v).Expand(%q, data) = %q, %v; want %q, <nil>", *e, template, got, err, want)
+	}
+}
+
+func TestExpanderEncoding(t *testing.T) {
+	data := map[string]any{
+		"q":      "hello world/ü",
+		"path":   "a b/ü",
+		"amount": 1.5,
+		"list":   []any{true, 2},
+		"priv":   "\ue000",
+	}
+	tests := []struct {
+		e        *Expander
+		template string
+		want     string
+	}{
+		{&Expander{LowerHex: true}, "/x/{q}", "/x/hello%20world%2f%c3%bc"},
+		{&Expander{LowerHex: true}, "/x/{+path}", "/x/a%20b/%c3%bc"},
+		{&Expander{FormSpaces: true}, "/x/{q}{?q}{&path}", "/x/hello%20world%2F%C3%BC?q=hello+world%2F%C3%BC&path=a+b%2F%C3%BC"},
+		{&Expander{IRI: true}, "/x/{q}{?q}", "/x/hello%20world%2Fü?q=hello%20world%2Fü"},
+		{&Expander{IRI: true}, "/x/{priv}{?priv}{#priv}", "/x/%EE%80%80?priv=\ue000#%EE%80%80"},
+		{
+			&Expander{
+				Format: func(v any) (string, bool, error) {
+					switch v := v.(type) {
+					case float64:
+						return fmt.Sprintf("%.2f", v), true, nil
+					case bool:
+						if v {
+							return "yes", true, nil
+						}
+						return "no", true, nil
+					default:
+						return "", false, nil
+					}
+				},
+			},
+			"{amount}{?list,q}",
+			"1.50?list=yes,2&q=hello%20world%2F%C3%BC",
+		},
+	}
+	for _, test := range tests {
+		got, err := test.e.Expand(test.template, data)
+		if got != test.want || err != nil {
+			t.Errorf("(%+v).Expand(%q, data) = %q, %v; want %q, <nil>", *test.e, test.template, got, err, test.want)
+		}
+	}
+
+	errFormat := errors.New("bad value")
+	e := &Expander{
+		Format: func(v any) (string, bool, error) {
+			return "", false, errFormat
+		},
+	}
+	if _, err := e.Expand("{amount}", data); !errors.Is(err, errFormat) {
+		t.Errorf("Expand with failing Format error = %v; want %v", err, errFormat)
+	}
+}
+
+func TestParts(t *testing.T) {
+	const template = "/users/{id}{?q,list*,name:3}#x"
+	tmpl, err := Parse(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Part{
+		{Pos: 0, End: 7, Literal: "/users/"},
+		{Pos: 7, End: 11, Expr: &Expression{
+			Operator: OpSimple,
+			Vars: []VarSpec{
+				{Name: "id", Pos: 8, End: 10},
+			},
+		}},
+		{Pos: 11, End: 28, Expr: &Expression{
+			Operator: OpQuery,
+			Vars: []VarSpec{
+				{Name: "q", Pos: 13, End: 14},
+				{Name: "list", Explode: true, Pos: 15, End: 20},
+				{Name: "name", MaxLength: 3, Pos: 21, End: 27},
+			},
+		}},
+		{Pos: 28, End: 30, Literal: "#x"},
+	}
+	got := tmpl.Parts()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(%q).Parts() = %+v; want %+v", template, got, want)
+	}
+	for _, p := range got {
+		if p.Expr == nil {
+			continue
+		}
+		if s := p.Expr.String(); s != template[p.Pos:p.End] {
+			t.Errorf("Expression.String() = %q; want %q", s, template[p.Pos:p.End])
+		}
+		for _, spec := range p.Expr.Vars {
+			if s := spec.String(); s != template[spec.Pos:spec.End] {
+				t.Errorf("VarSpec.String() = %q; want %q", s, template[spec.Pos:spec.End])
+			}
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	const template = "{/path*}{?q,limit}{&q:3}"
+	want := []Variable{
+		{
+			Name: "path",
+			Refs: []VarRef{
+				{Operator: OpPathSegment, VarSpec: VarSpec{Name: "path", Explode: true, Pos: 2, End: 7}},
+			},
+		},
+		{
+			Name: "q",
+			Refs: []VarRef{
+				{Operator: OpQuery, VarSpec: VarSpec{Name: "q", Pos: 10, End: 11}},
+				{Operator: OpQueryContinuation, VarSpec: VarSpec{Name: "q", MaxLength: 3, Pos: 20, End: 23}},
+			},
+		},
+		{
+			Name: "limit",
+			Refs: []VarRef{
+				{Operator: OpQuery, VarSpec: VarSpec{Name: "limit", Pos: 12, End: 17}},
+			},
+		},
+	}
+	got := MustParse(template).Variables()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(%q).Variables() = %+v; want %+v", template, got, want)
+	}
+}
+
 func BenchmarkExpand(b *testing.B) {
 	b.Run("Simple", func(b *testing.B) {
 		b.ReportAllocs()
@@ -609,12 +1766,58 @@ func BenchmarkExpand(b *testing.B) {
 	})
 }
 
+func BenchmarkTemplateExpand(b *testing.B) {
+	b.Run("Simple", func(b *testing.B) {
+		tmpl := MustParse("{var}")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tmpl.Expand(expansionSectionData)
+		}
+	})
+
+	b.Run("SimpleStructData", func(b *testing.B) {
+		tmpl := MustParse("{var}")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tmpl.Expand(struct{ Var string }{"value"})
+		}
+	})
+
+	b.Run("Complex", func(b *testing.B) {
+		tmpl := MustParse("{.dom*}/{keys}{?list}")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tmpl.Expand(expansionSectionData)
+		}
+	})
+}
+
+func BenchmarkAppendExpand(b *testing.B) {
+	tmpl := MustParse("{.dom*}/{keys}{?list}")
+	b.ReportAllocs()
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		buf, _ = tmpl.AppendExpand(buf[:0], expansionSectionData)
+	}
+}
+
 func FuzzExpand(f *testing.F) {
 	for _, test := range tests {
 		f.Add(test.template)
 	}
 
 	f.Fuzz(func(t *testing.T, template string) {
-		Expand(template, expansionSectionData)
+		want, wantErr := Expand(template, expansionSectionData)
+		tmpl, err := Parse(template)
+		if err != nil {
+			if wantErr == nil {
+				t.Errorf("Parse(%q) = _, %v; Expand succeeded", template, err)
+			}
+			return
+		}
+		got, err := tmpl.Expand(expansionSectionData)
+		if got != want || (err == nil) != (wantErr == nil) {
+			t.Errorf("Parse(%q).Expand(...) = %q, %v; Expand(...) = %q, %v", template, got, err, want, wantErr)
+		}
 	})
 }